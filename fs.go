@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cleanpath/pkg/cleanpath"
+)
+
+// maxSymlinkHops is the default bound on symlink map resolution, matching the Linux MAXSYMLINKS limit.
+const maxSymlinkHops = 40
+
+// compareResolution returns the lexical and symlink-resolved forms of an existing
+// absolute path and whether they differ.
+func compareResolution(path string) (string, string, bool) {
+	physical, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", "", false
+	}
+	logical := filepath.Clean(path)
+	return logical, physical, logical != physical
+}
+
+// pathKind classifies path with lstat as dir, file, symlink, other, or missing.
+func pathKind(path string) string {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "missing"
+	}
+	switch mode := info.Mode(); {
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	}
+	return "other"
+}
+
+// resolveRealpath resolves symlinks in path on the filesystem, returning path unchanged when
+// it cannot be resolved (e.g. it does not exist). Relative paths are resolved against
+// baseAbs and stay relative to it.
+func resolveRealpath(path, baseAbs string) string {
+	resolved, err := filepath.EvalSymlinks(cleanpath.MakeAbsolute(path, baseAbs))
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(path, "/") {
+		return resolved
+	}
+	return cleanpath.MakeRelative(resolved, baseAbs, 0, true)
+}
+
+// resolvedLinks lists the symlinked components of the path -R resolved, taken from the
+// realpath step in steps. -R leaves a path without symlinks unchanged, so no step means none.
+func resolvedLinks(steps []logStep, baseAbs string) []string {
+	for _, step := range steps {
+		if step.name == "realpath" {
+			return symlinkComponents(step.from, baseAbs)
+		}
+	}
+	return nil
+}
+
+// symlinkComponents returns the names of the components of a cleaned path that are
+// symlinks, checking each leading prefix with os.Lstat so earlier links are followed on
+// the way down. A relative path is walked from baseAbs, and only its own components count.
+func symlinkComponents(path, baseAbs string) []string {
+	prefix := ""
+	if !strings.HasPrefix(path, "/") {
+		prefix = baseAbs
+	}
+	var links []string
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "" || seg == "." {
+			continue
+		}
+		prefix = strings.TrimSuffix(prefix, "/") + "/" + seg
+		if seg == ".." {
+			continue
+		}
+		if info, err := os.Lstat(prefix); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, seg)
+		}
+	}
+	return links
+}
+
+// pathExists reports whether path exists, checking the link itself unless followLinks is set.
+func pathExists(path string, followLinks bool) bool {
+	var err error
+	if followLinks {
+		_, err = os.Stat(path)
+	} else {
+		_, err = os.Lstat(path)
+	}
+	return err == nil
+}
+
+// isNewer reports whether the file at path was modified after the given time.
+func isNewer(path string, after time.Time) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return info.ModTime().After(after), nil
+}
+
+// loadSymlinkMap reads "linkpath -> target" lines into a map keyed by cleaned link path.
+func loadSymlinkMap(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read --symlink-map: %v", err)
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read --symlink-map: %v", err)
+	}
+	links := make(map[string]string, len(lines))
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		link, target, ok := strings.Cut(line, "->")
+		link = strings.TrimSpace(link)
+		target = strings.TrimSpace(target)
+		if !ok || !strings.HasPrefix(link, "/") || target == "" {
+			return nil, fmt.Errorf("invalid --symlink-map line %d: %q", i+1, line)
+		}
+		links[cleanpath.Clean(link)] = target
+	}
+	return links, nil
+}
+
+// loadRewriteFile reads 'old -> new' prefix rules, one per line, keyed by the cleaned old prefix.
+func loadRewriteFile(file, sep string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read --rewrite-file: %v", err)
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read --rewrite-file: %v", err)
+	}
+	rewrites := make(map[string]string, len(lines))
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		old, replacement, ok := strings.Cut(line, "->")
+		old = strings.TrimSpace(old)
+		replacement = strings.TrimSpace(replacement)
+		if !ok || old == "" || replacement == "" {
+			return nil, fmt.Errorf("invalid --rewrite-file line %d: %q", i+1, line)
+		}
+		rewrites[cleanpath.CleanSep(old, sep)] = replacement
+	}
+	return rewrites, nil
+}
+
+// rewritePrefix replaces the longest segment-aligned prefix of the cleaned path found in rewrites.
+// Paths with no matching prefix are returned unchanged.
+func rewritePrefix(path string, rewrites map[string]string, sep string) string {
+	cleaned := cleanpath.CleanSep(path, sep)
+	prefix := cleaned
+	for {
+		if replacement, ok := rewrites[prefix]; ok {
+			rest := strings.TrimPrefix(cleaned[len(prefix):], sep)
+			if rest == "" {
+				return replacement
+			}
+			return replacement + sep + rest
+		}
+		i := strings.LastIndex(prefix, sep)
+		switch {
+		case i < 0 || prefix == sep:
+			return path
+		case i == 0:
+			prefix = sep
+		default:
+			prefix = prefix[:i]
+		}
+	}
+}
+
+// resolveSymlinkMap resolves an absolute path component by component, following at most maxHops links
+// from the map so that ".." applies to the link target rather than the lexical parent.
+func resolveSymlinkMap(path string, links map[string]string, maxHops int) (string, error) {
+	pending := strings.Split(path, "/")
+	var resolved []string
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		target, ok := links["/"+strings.Join(append(resolved, part), "/")]
+		if !ok {
+			resolved = append(resolved, part)
+			continue
+		}
+		hops++
+		if hops > maxHops {
+			return path, fmt.Errorf("too many levels of symbolic links (limit %d)", maxHops)
+		}
+		// Relative targets are resolved from the link's directory.
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return "/" + strings.Join(resolved, "/"), nil
+}
+
+// resolveBaseAbs resolves the base path into an absolute, cleaned path.
+func resolveBaseAbs(base string) (string, error) {
+	if base == "" {
+		base = "."
+	}
+	if strings.HasPrefix(base, "/") {
+		return cleanpath.Clean(base), nil
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve base: %v", err)
+	}
+	return cleanpath.Clean(pwd + "/" + base), nil
+}
+
+// resolveBaseAbsSep resolves the base for a custom separator, where it must already be absolute.
+func resolveBaseAbsSep(base, sep string) (string, error) {
+	if !strings.HasPrefix(base, sep) {
+		return "", fmt.Errorf("with --sep %q, the base must start with %q", sep, sep)
+	}
+	return cleanpath.CleanSep(base, sep), nil
+}
+
+// passesFilters reports whether final survives --only-existing, --only-missing, and
+// --newer-than, checking a relative final against the base. A path --newer-than cannot stat is dropped when it is missing, unless
+// --newer-missing=error, and any other stat failure is returned.
+func passesFilters(final string, opts options) (bool, error) {
+	abs := cleanpath.MakeAbsolute(final, opts.baseAbs)
+	if opts.onlyExisting || opts.onlyMissing {
+		if pathExists(abs, opts.followLinks) != opts.onlyExisting {
+			return false, nil
+		}
+	}
+	if opts.newerFilter {
+		keep, err := isNewer(abs, opts.newerThan)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && opts.newerMissing != "error" {
+				return false, nil
+			}
+			return false, err
+		}
+		return keep, nil
+	}
+	return true, nil
+}
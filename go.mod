@@ -1,3 +1,5 @@
 module cleanpath
 
 go 1.25.4
+
+require golang.org/x/text v0.31.0
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+
+	"cleanpath/pkg/cleanpath"
+)
+
+// resolveUserHome resolves the target user's home directory and name. With windows,
+// another user's home is their profile directory next to the current user's; getent
+// is passed on to lookupUserHome.
+func resolveUserHome(userName string, sources []string, windows, getent bool) (string, string) {
+	currentName, currentHome := currentUser(sources)
+	if userName == "" {
+		return currentHome, currentName
+	}
+	if windows {
+		return cleanpath.WindowsProfile(currentHome, userName), userName
+	}
+	home, name := lookupUserHome(userName, getent)
+	if name == "" {
+		return currentHome, ""
+	}
+	return home, name
+}
+
+// getentPasswd runs getent passwd NAME and returns its output; tests replace it.
+var getentPasswd = func(name string) (string, error) {
+	out, err := exec.Command("getent", "passwd", name).Output()
+	return string(out), err
+}
+
+// getentCache memoizes getent passwd homes by name, like the user.Lookup cache.
+var getentCache sync.Map
+
+// lookupUserHome returns a user's home directory and name from the user database.
+// With getent set, users it does not know (such as LDAP users in a binary built
+// without cgo) are looked up with getent passwd, when that command is available.
+// It returns empty strings for an unknown user.
+func lookupUserHome(name string, getent bool) (string, string) {
+	if lookup, err := cleanpath.LookupUser(name); err == nil {
+		return lookup.HomeDir, lookup.Username
+	}
+	if !getent {
+		return "", ""
+	}
+	if cached, ok := getentCache.Load(name); ok {
+		home := cached.(string)
+		if home == "" {
+			return "", ""
+		}
+		return home, name
+	}
+	home := ""
+	if out, err := getentPasswd(name); err == nil {
+		fields := strings.Split(strings.TrimSpace(out), ":")
+		if len(fields) >= 7 && fields[0] == name {
+			home = fields[5]
+		}
+	}
+	getentCache.Store(name, home)
+	if home == "" {
+		return "", ""
+	}
+	return home, name
+}
+
+// passwdFile is the user database read by --all-users; tests replace it.
+var passwdFile = "/etc/passwd"
+
+// loadPasswdHomes reads the home directory of every user in a passwd(5) file as a ~name
+// candidate, skipping the primary home (which keeps ~), homes of "/" or relative homes, and
+// homes already claimed by an earlier entry. The file is read once, so lookups stay cheap.
+func loadPasswdHomes(file, primary string) ([]cleanpath.Home, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read user database for --all-users: %v", err)
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read user database for --all-users: %v", err)
+	}
+	seen := map[string]bool{cleanpath.Clean(primary): true}
+	var homes []cleanpath.Home
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] == "" {
+			continue
+		}
+		home := cleanpath.Clean(fields[5])
+		if home == "/" || !strings.HasPrefix(home, "/") || seen[home] {
+			continue
+		}
+		seen[home] = true
+		homes = append(homes, cleanpath.Home{Dir: home, Prefix: "~" + fields[0]})
+	}
+	return homes, nil
+}
+
+// currentUser returns the current username and home directory, falling back to env vars.
+// When sources is set, the home directory comes from the first non-empty source instead.
+func currentUser(sources []string) (string, string) {
+	lookup, err := user.Current()
+	if len(sources) > 0 {
+		name := os.Getenv("USER")
+		if err == nil {
+			name = lookup.Username
+		}
+		return name, homeFromSources(sources)
+	}
+	if err == nil {
+		return lookup.Username, lookup.HomeDir
+	}
+	return os.Getenv("USER"), os.Getenv("HOME")
+}
+
+// windowsHomeSources is the -w home order: %USERPROFILE%, then %HOMEDRIVE%%HOMEPATH%.
+var windowsHomeSources = []string{"env:USERPROFILE", "env:HOMEDRIVE+HOMEPATH"}
+
+// parseHomeSources splits and validates a --home-sources list.
+func parseHomeSources(raw string) ([]string, error) {
+	sources := strings.Split(raw, ",")
+	for _, source := range sources {
+		if source == "passwd" {
+			continue
+		}
+		if names, ok := strings.CutPrefix(source, "env:"); ok && !slices.Contains(strings.Split(names, "+"), "") {
+			continue
+		}
+		return nil, fmt.Errorf("invalid --home-sources entry: %q", source)
+	}
+	return sources, nil
+}
+
+// homeFromSources returns the home directory from the first source that provides one.
+func homeFromSources(sources []string) string {
+	for _, source := range sources {
+		home := ""
+		if source == "passwd" {
+			if lookup, err := user.Current(); err == nil {
+				home = lookup.HomeDir
+			}
+		} else {
+			home = envConcat(strings.Split(strings.TrimPrefix(source, "env:"), "+"))
+		}
+		if home != "" {
+			return home
+		}
+	}
+	return ""
+}
+
+// envConcat joins the values of names, or returns "" if any of them is unset or empty.
+func envConcat(names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		value := os.Getenv(name)
+		if value == "" {
+			return ""
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+// homeToEnv replaces a leading home directory with $HOME on a segment boundary, matched
+// as cleanpath.UnexpandTilde matches it.
+func homeToEnv(path, home string, windows bool) string {
+	if home == "" || !cleanpath.HasHomePrefix(path, home, windows) {
+		return path
+	}
+	return "$HOME" + path[len(home):]
+}
+
+// inEnvScope reports whether env expansion applies to a path under --env-within.
+func inEnvScope(path string, opts options) bool {
+	return opts.envWithin == "" || hasPathPrefix(cleanpath.Clean(path), opts.envWithin)
+}
+
+// hasPathPrefix reports whether path equals prefix or lies beneath it on a segment boundary.
+func hasPathPrefix(path, prefix string) bool {
+	if path == prefix || prefix == "/" && strings.HasPrefix(path, "/") {
+		return true
+	}
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+// loadEnvSnapshot reads NAME=VALUE lines as written by env. Blank lines and lines
+// without "=" (such as continuations of multi-line values) are skipped.
+func loadEnvSnapshot(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read --env-snapshot: %v", err)
+	}
+	defer f.Close()
+
+	lines, err := readLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read --env-snapshot: %v", err)
+	}
+	entries := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if name, _, ok := strings.Cut(line, "="); ok && name != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// envOrderAndValues resolves the env var order and values for expansion or unexpansion
+// from environ, a list of NAME=VALUE entries.
+func envOrderAndValues(names []string, expandAll bool, environ []string) ([]string, map[string]string) {
+	if containsAllMarker(names) || (expandAll && len(names) == 0) {
+		env := environ
+		order := make([]string, 0, len(env))
+		values := make(map[string]string, len(env))
+		for _, entry := range env {
+			parts := strings.SplitN(entry, "=", 2)
+			key := parts[0]
+			val := ""
+			if len(parts) == 2 {
+				val = parts[1]
+			}
+			order = append(order, key)
+			values[key] = val
+		}
+		return order, values
+	}
+
+	if len(names) == 0 {
+		return nil, map[string]string{}
+	}
+
+	current := make(map[string]string, len(environ))
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		current[name] = value
+	}
+	order := make([]string, 0, len(names))
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		order = append(order, name)
+		values[name] = current[name]
+	}
+	return order, values
+}
+
+// containsAllMarker checks if the "-" sentinel appears in the name list.
+func containsAllMarker(names []string) bool {
+	for _, name := range names {
+		if name == "-" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileBatch holds the records of one -f file and, with --parallel-files, the results
+// for each record's inputs.
+type fileBatch struct {
+	name    string
+	lines   []string
+	results [][]transformResult
+	err     error
+}
+
+// readFileBatches reads each -f file in order. With --parallel-files every file is read
+// and transformed on its own goroutine; the batches still come back in argument order so
+// output stays grouped by file.
+func readFileBatches(files []string, opts options) []fileBatch {
+	batches := make([]fileBatch, len(files))
+	load := func(i int) {
+		batch := &batches[i]
+		batch.name = files[i]
+		f, err := os.Open(files[i])
+		if err != nil {
+			batch.err = err
+			return
+		}
+		defer f.Close()
+		batch.lines, err = readRecords(f, opts.null)
+		if err != nil {
+			batch.err = fmt.Errorf("reading %s: %v", files[i], err)
+			return
+		}
+		if !opts.parallelFiles {
+			return
+		}
+		batch.results = make([][]transformResult, len(batch.lines))
+		for j, line := range batch.lines {
+			// An expansion error is reported when run reaches this line.
+			inputs, _ := expandInput(line, opts)
+			for _, input := range inputs {
+				batch.results[j] = append(batch.results[j], transformInput(input, opts))
+			}
+		}
+	}
+
+	if !opts.parallelFiles {
+		for i := range files {
+			load(i)
+		}
+		return batches
+	}
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			load(i)
+		}(i)
+	}
+	wg.Wait()
+	return batches
+}
+
+// scanNull is a bufio.SplitFunc that splits on NUL bytes, like find -print0 output.
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// recordTerminator returns the output record terminator: NUL with -0, else a newline.
+func recordTerminator(null bool) string {
+	if null {
+		return "\x00"
+	}
+	return "\n"
+}
+
+// inlineOptionsPrefix marks a first stdin line that supplies default flags.
+const inlineOptionsPrefix = "#cleanpath:"
+
+// readsStdin reports whether run will read paths from stdin.
+func readsStdin(opts options, paths []string) bool {
+	if opts.readInput {
+		return true
+	}
+	if opts.literalDash {
+		return false
+	}
+	for _, arg := range paths {
+		if arg == "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// readLines reads every line from r.
+func readLines(r io.Reader) ([]string, error) {
+	return readRecords(r, false)
+}
+
+// readRecords reads every line from r, or every NUL-terminated record when null is set.
+func readRecords(r io.Reader, null bool) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	if null {
+		scanner.Split(scanNull)
+	}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+var braceRangePattern = regexp.MustCompile(`^(-?\d+)\.\.(-?\d+)$`)
+
+// maxBraceExpansions bounds both a single {first..last} range and the total number of
+// paths one input may expand to, so a typo like {1..9999999999} fails instead of
+// exhausting memory.
+const maxBraceExpansions = 10000
+
+// expandBraces expands shell-style {a,b} alternations and {1..3} ranges into multiple paths.
+func expandBraces(path string) ([]string, error) {
+	return expandBracesFrom(path, 0)
+}
+
+// expandBracesFrom expands the first brace group at or after from, recursing on each result.
+func expandBracesFrom(path string, from int) ([]string, error) {
+	open, close, commas := findBraceGroup(path, from)
+	if open == -1 {
+		return []string{unescapeBraces(path)}, nil
+	}
+
+	prefix := path[:open]
+	suffix := path[close+1:]
+	inner := path[open+1 : close]
+
+	var alternatives []string
+	if len(commas) > 0 {
+		start := open + 1
+		for _, comma := range commas {
+			alternatives = append(alternatives, path[start:comma])
+			start = comma + 1
+		}
+		alternatives = append(alternatives, path[start:close])
+	} else if m := braceRangePattern.FindStringSubmatch(inner); m != nil {
+		var err error
+		if alternatives, err = expandBraceRange(m[1], m[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Groups that are neither alternations nor ranges stay literal; keep scanning inside them.
+	if alternatives == nil {
+		return expandBracesFrom(path, open+1)
+	}
+
+	var out []string
+	for _, alt := range alternatives {
+		expanded, err := expandBracesFrom(prefix+alt+suffix, len(prefix))
+		if err != nil {
+			return nil, err
+		}
+		if len(out)+len(expanded) > maxBraceExpansions {
+			return nil, fmt.Errorf("brace expansion produces more than %d paths", maxBraceExpansions)
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// findBraceGroup locates the next unescaped brace group and its top-level comma positions.
+func findBraceGroup(path string, from int) (int, int, []int) {
+	for i := from; i < len(path); i++ {
+		if isBraceEscape(path, i) {
+			i++
+			continue
+		}
+		// Leave ${VAR} references for env expansion.
+		if path[i] != '{' || (i > 0 && path[i-1] == '$') {
+			continue
+		}
+
+		depth := 0
+		var commas []int
+		for j := i; j < len(path); j++ {
+			if isBraceEscape(path, j) {
+				j++
+				continue
+			}
+			switch path[j] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					return i, j, commas
+				}
+			case ',':
+				if depth == 1 {
+					commas = append(commas, j)
+				}
+			}
+		}
+	}
+	return -1, -1, nil
+}
+
+// isBraceEscape reports whether a backslash at i escapes a brace or comma.
+func isBraceEscape(path string, i int) bool {
+	return path[i] == '\\' && i+1 < len(path) && strings.ContainsRune("{},", rune(path[i+1]))
+}
+
+// unescapeBraces drops the backslash from escaped braces and commas.
+func unescapeBraces(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if isBraceEscape(path, i) {
+			i++
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// expandBraceRange expands the numeric bounds of a {first..last} range in either direction.
+// Ranges of more than maxBraceExpansions numbers are rejected before anything is built.
+func expandBraceRange(firstRaw, lastRaw string) ([]string, error) {
+	tooLarge := fmt.Errorf("brace range {%s..%s} has more than %d elements", firstRaw, lastRaw, maxBraceExpansions)
+	first, err := strconv.Atoi(firstRaw)
+	if err != nil {
+		return nil, tooLarge
+	}
+	last, err := strconv.Atoi(lastRaw)
+	if err != nil {
+		return nil, tooLarge
+	}
+	low, high := min(first, last), max(first, last)
+	// high-low wraps negative when the span overflows an int.
+	if span := high - low; span < 0 || span >= maxBraceExpansions {
+		return nil, tooLarge
+	}
+	step := 1
+	if last < first {
+		step = -1
+	}
+	var out []string
+	for n := first; ; n += step {
+		out = append(out, strconv.Itoa(n))
+		if n == last {
+			break
+		}
+	}
+	return out, nil
+}
+
+// inlineFlags lists the flags a #cleanpath: header may set, mapped to whether each
+// takes a value. Stdin is data, so only flags that shape the transform are allowed:
+// nothing that opens or writes a file, selects inputs, or prompts.
+var inlineFlags = map[string]bool{
+	"w": false, "windows": false, "t": false, "tilda": false, "T": false, "untilda": false,
+	"e": false, "env": false, "env-within": true, "env-subst": false, "win-env": false,
+	"clean-after-env": false, "clean-env-values": false, "E": false, "unenv": false, "x": true, "eXpand": true,
+	"a": false, "absolute": false, "A": false, "unabsolute": false, "b": true, "base": true,
+	"p": true, "parent": true, "max-up": true, "prefer-relative": false, "prefer-shorter": false,
+	"include-base-name": false, "relative-strict": false, "strict-parent": false, "no-clean-absolute": false,
+	"root-marker": true, "top": true, "sibling-dot": false, "dot-slash": false,
+	"o": true, "old": true, "n": true, "new": true, "fixed": false, "regex-timeout": true,
+	"unexpand-after-regex": false, "O": true, "order": true, "home-fallback": true, "home-to-env": false,
+	"sep": true, "target-os": true, "posix": false, "keep-double-slash": false, "slashes-only": false,
+	"k": false, "keep-trailing": false, "l": false, "lowercase": false, "trim-space": false,
+	"dotfiles": true, "replace-ext": true, "rename-segment": true, "prepend": true, "append": true,
+	"decode-percent": false, "percent-encode": false, "brace-expand": false,
+}
+
+// checkInlineFlags returns an error naming the first #cleanpath: header token that is
+// not one of inlineFlags.
+func checkInlineFlags(header []string) error {
+	args := expandCombinedArgs(header)
+	for i := 0; i < len(args); i++ {
+		flagName, _, hasValue := strings.Cut(args[i], "=")
+		if !strings.HasPrefix(flagName, "-") {
+			return fmt.Errorf("inline options may only contain flags: %q", args[i])
+		}
+		takesValue, ok := inlineFlags[strings.TrimPrefix(strings.TrimPrefix(flagName, "-"), "-")]
+		if !ok {
+			return fmt.Errorf("inline options may not set %s", flagName)
+		}
+		if takesValue && !hasValue {
+			i++
+		}
+	}
+	return nil
+}
+
+// applyInlineOptions reads the stdin records and, when the first one is a
+// #cleanpath: header, reparses the arguments with its flags in front. It returns the
+// options to use and a reader over the remaining records, or false after reporting
+// an error.
+func applyInlineOptions(opts options, args, paths []string, r io.Reader, stdout, stderr io.Writer) (options, io.Reader, bool) {
+	lines, err := readRecords(r, opts.null)
+	if err != nil {
+		fmt.Fprintf(stderr, "cleanpath: reading stdin: %v\n", err)
+		return opts, r, false
+	}
+	if len(lines) > 0 && strings.HasPrefix(lines[0], inlineOptionsPrefix) {
+		header := strings.Fields(strings.TrimPrefix(lines[0], inlineOptionsPrefix))
+		if err := checkInlineFlags(header); err != nil {
+			fmt.Fprintf(stderr, "cleanpath: %v\n", err)
+			return opts, r, false
+		}
+		inlineOpts, inlinePaths, err := parseArgs(append(header, args...), stdout, stderr)
+		if err != nil {
+			return opts, r, false
+		}
+		if len(inlinePaths) != len(paths) {
+			fmt.Fprintf(stderr, "cleanpath: inline options may only contain flags: %q\n", lines[0])
+			return opts, r, false
+		}
+		opts = inlineOpts
+		lines = lines[1:]
+	}
+	terminator := recordTerminator(opts.null)
+	var rest strings.Builder
+	for _, line := range lines {
+		rest.WriteString(line + terminator)
+	}
+	return opts, strings.NewReader(rest.String()), true
+}
+
+// gatherInputs returns every input in processing order: -f file records, then the
+// arguments (a lone "-" reads stdin records in its place), then -i stdin records.
+// sources names the file each leading record came from, and precomputed holds the
+// results already computed by --parallel-files or --jobs; both line up with the
+// inputs by index.
+func gatherInputs(paths []string, r io.Reader, opts options) ([]string, []string, [][]transformResult, error) {
+	if !opts.literalDash {
+		var expanded []string
+		for _, arg := range paths {
+			if arg != "-" {
+				expanded = append(expanded, arg)
+				continue
+			}
+			lines, err := readRecords(r, opts.null)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("reading stdin: %w", err)
+			}
+			expanded = append(expanded, lines...)
+		}
+		paths = expanded
+	}
+
+	var sources []string
+	var precomputed [][]transformResult
+	if len(opts.fromFiles) > 0 {
+		var lines []string
+		for _, batch := range readFileBatches(opts.fromFiles, opts) {
+			if batch.err != nil {
+				return nil, nil, nil, batch.err
+			}
+			for i, line := range batch.lines {
+				lines = append(lines, line)
+				sources = append(sources, batch.name)
+				if opts.parallelFiles {
+					precomputed = append(precomputed, batch.results[i])
+				}
+			}
+		}
+		paths = append(lines, paths...)
+	}
+
+	if opts.readInput {
+		lines, err := readRecords(r, opts.null)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading stdin: %w", err)
+		}
+		paths = append(paths, lines...)
+	}
+
+	// With --jobs every input not already transformed by --parallel-files is transformed
+	// up front; the results stay aligned with paths, so output keeps input order.
+	if opts.jobs > 1 {
+		precomputed = transformConcurrently(paths, precomputed, opts)
+	}
+	return paths, sources, precomputed, nil
+}
@@ -1,33 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
-)
-
-// TestCleanPath verifies basic normalization cases.
-func TestCleanPath(t *testing.T) {
-	cases := map[string]string{
-		"./aa/bb":        "aa/bb",
-		"/tmp/./aa//bb/": "/tmp/aa/bb",
-		"/":              "/",
-		"/../a":          "/a",
-		"/../../":        "/",
-		"../a":           "../a",
-		"../..":          "../..",
-		"a/../b":         "b",
-		"":               ".",
-		"a//b//c/..":     "a/b",
-	}
+	"time"
 
-	for input, want := range cases {
-		got := cleanPath(input)
-		if got != want {
-			t.Fatalf("cleanPath(%q) = %q, want %q", input, got, want)
-		}
-	}
-}
+	"cleanpath/pkg/cleanpath"
+)
 
 // TestRunWithStdin verifies stdin input handling.
 func TestRunWithStdin(t *testing.T) {
@@ -73,7 +63,10 @@ func TestEnvExpand(t *testing.T) {
 		},
 	}
 
-	got := transformPath("$FOO/baz", opts)
+	got, err := transformPath("$FOO/baz", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "bar/baz" {
 		t.Fatalf("transformPath env expand = %q, want %q", got, "bar/baz")
 	}
@@ -92,7 +85,10 @@ func TestEnvUnexpandOrder(t *testing.T) {
 		},
 	}
 
-	got := transformPath("/path/foobar", opts)
+	got, err := transformPath("/path/foobar", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "/path/$Abar" {
 		t.Fatalf("transformPath env unexpand order = %q, want %q", got, "/path/$Abar")
 	}
@@ -105,7 +101,10 @@ func TestEnvUnexpandDefaultNone(t *testing.T) {
 		envUnexpand: true,
 	}
 
-	got := transformPath("/path/bar", opts)
+	got, err := transformPath("/path/bar", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "/path/bar" {
 		t.Fatalf("transformPath env unexpand default = %q, want %q", got, "/path/bar")
 	}
@@ -120,7 +119,10 @@ func TestTildeUnexpandUser(t *testing.T) {
 		resolvedUser:  "",
 	}
 
-	got := transformPath("/home/me/docs", opts)
+	got, err := transformPath("/home/me/docs", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "~-/docs" {
 		t.Fatalf("transformPath tilda unexpand = %q, want %q", got, "~-/docs")
 	}
@@ -129,11 +131,13 @@ func TestTildeUnexpandUser(t *testing.T) {
 // TestRegexReplace verifies regex replacement is applied.
 func TestRegexReplace(t *testing.T) {
 	opts := options{
-		regex:      regexp.MustCompile("aa+"),
-		newPattern: "a",
+		replacements: []replacement{{regex: regexp.MustCompile("aa+"), new: "a"}},
 	}
 
-	got := transformPath("caaa", opts)
+	got, err := transformPath("caaa", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "ca" {
 		t.Fatalf("transformPath regex = %q, want %q", got, "ca")
 	}
@@ -146,7 +150,10 @@ func TestMakeAbsolute(t *testing.T) {
 		baseAbs:  "/tmp/some-dir",
 	}
 
-	got := transformPath("xxx", opts)
+	got, err := transformPath("xxx", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "/tmp/some-dir/xxx" {
 		t.Fatalf("transformPath absolute = %q, want %q", got, "/tmp/some-dir/xxx")
 	}
@@ -159,7 +166,10 @@ func TestMakeAbsoluteAlreadyAbs(t *testing.T) {
 		baseAbs:  "/tmp/some-dir",
 	}
 
-	got := transformPath("/tmp/foo", opts)
+	got, err := transformPath("/tmp/foo", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "/tmp/foo" {
 		t.Fatalf("transformPath absolute = %q, want %q", got, "/tmp/foo")
 	}
@@ -174,7 +184,10 @@ func TestMakeRelativePrefix(t *testing.T) {
 		unlimitedUp: false,
 	}
 
-	got := transformPath("/tmp/some-dir/another-dir/xxx", opts)
+	got, err := transformPath("/tmp/some-dir/another-dir/xxx", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
 	if got != "another-dir/xxx" {
 		t.Fatalf("transformPath unabsolute = %q, want %q", got, "another-dir/xxx")
 	}
@@ -201,9 +214,3095 @@ func TestMakeRelativeParentLimit(t *testing.T) {
 			parentLimit: tc.limit,
 			unlimitedUp: tc.unlimited,
 		}
-		got := transformPath("/tmp/foo", opts)
+		got, err := transformPath("/tmp/foo", opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
 		if got != tc.want {
 			t.Fatalf("%s: transformPath unabsolute = %q, want %q", tc.name, got, tc.want)
 		}
 	}
 }
+
+// TestExpandBraces verifies alternations, ranges, nesting, and escapes.
+func TestExpandBraces(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{input: "/opt/{bin,sbin}/tool", want: []string{"/opt/bin/tool", "/opt/sbin/tool"}},
+		{input: "a/{b,c{1,2}}/d", want: []string{"a/b/d", "a/c1/d", "a/c2/d"}},
+		{input: "log.{1..3}", want: []string{"log.1", "log.2", "log.3"}},
+		{input: "log.{2..0}", want: []string{"log.2", "log.1", "log.0"}},
+		{input: `a/\{b,c\}`, want: []string{"a/{b,c}"}},
+		{input: "a/{b}/c", want: []string{"a/{b}/c"}},
+		{input: "${HOME}/x", want: []string{"${HOME}/x"}},
+		{input: "a/{b,c", want: []string{"a/{b,c"}},
+	}
+
+	for _, tc := range cases {
+		got, err := expandBraces(tc.input)
+		if err != nil || strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Fatalf("expandBraces(%q) = %q, %v, want %q", tc.input, got, err, tc.want)
+		}
+	}
+}
+
+// TestExpandBracesLimit verifies oversized ranges and products fail instead of allocating.
+func TestExpandBracesLimit(t *testing.T) {
+	for _, input := range []string{"a{1..9999999999}", "a{-9223372036854775808..9223372036854775807}", "a{0..99999999999999999999}", "{1..200}{1..200}"} {
+		if got, err := expandBraces(input); err == nil {
+			t.Fatalf("expandBraces(%q) returned %d paths, want an error", input, len(got))
+		}
+	}
+	if got, err := expandBraces("{1..10000}"); err != nil || len(got) != 10000 {
+		t.Fatalf("expandBraces({1..10000}) = %d paths, %v, want 10000 paths", len(got), err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--brace-expand", "a{1..9999999999}", "b/{x,y}"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 || out.String() != "b/x\nb/y\n" {
+		t.Fatalf("run = %d, %q, want 1 and the remaining paths", code, out.String())
+	}
+	if !strings.Contains(errOut.String(), "more than 10000 elements") {
+		t.Fatalf("stderr = %q, want the range limit error", errOut.String())
+	}
+}
+
+// TestRunBraceExpand verifies each brace expansion is cleaned and printed.
+func TestRunBraceExpand(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--brace-expand", "/opt/{bin,sbin}/../tool"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+
+	want := "/opt/tool\n/opt/tool\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestRunNewerThan verifies only paths modified after the cutoff are emitted.
+func TestRunNewerThan(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	for _, p := range []string{oldPath, newPath} {
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(oldPath, cutoff.Add(-time.Hour), cutoff.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(newPath, cutoff.Add(time.Hour), cutoff.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut strings.Builder
+	args := []string{"--newer-than", cutoff.Format(time.RFC3339), oldPath, newPath, dir + "/missing"}
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != newPath+"\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), newPath+"\n")
+	}
+
+	out.Reset()
+	errOut.Reset()
+	args = []string{"--newer-than-file", oldPath, "--newer-than-missing", "error", newPath, dir + "/missing"}
+	code = run(args, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1", code)
+	}
+	if out.String() != newPath+"\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), newPath+"\n")
+	}
+	if !strings.Contains(errOut.String(), "missing") {
+		t.Fatalf("stderr did not report missing path, got %q", errOut.String())
+	}
+
+	// -A makes the outputs relative; they are still checked against the base, not the cwd.
+	for _, mode := range []string{"skip", "error"} {
+		out.Reset()
+		errOut.Reset()
+		args = []string{"-A", "-b", dir, "--newer-than", cutoff.Format(time.RFC3339), "--newer-than-missing", mode, oldPath, newPath}
+		code = run(args, strings.NewReader(""), &out, &errOut)
+		if code != 0 || out.String() != "new\n" {
+			t.Fatalf("run with -A and --newer-than-missing %s = %d, %q (stderr %q), want %q", mode, code, out.String(), errOut.String(), "new\n")
+		}
+	}
+}
+
+// TestRegexTimeout verifies a slow replacement reports an error instead of hanging.
+func TestRegexTimeout(t *testing.T) {
+	opts := options{
+		replacements: []replacement{{regex: regexp.MustCompile(`(a|b)*c`), new: "x"}},
+		regexTimeout: time.Nanosecond,
+	}
+
+	_, err := transformPath(strings.Repeat("ab", 1<<20), opts)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("transformPath regex timeout error = %v, want timeout", err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"-o", "(a|b)*c", "-n", "x", "--regex-timeout", "1ns", strings.Repeat("ab", 1<<20), "abc"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1", code)
+	}
+	if !strings.Contains(errOut.String(), "timed out") {
+		t.Fatalf("stderr did not report timeout, got %q", errOut.String())
+	}
+	want := fmt.Sprintf("cleanpath: %q…: regex replacement timed out after 1ns\n", strings.Repeat("ab", 40))
+	if !strings.HasPrefix(errOut.String(), want) {
+		t.Fatalf("stderr = %.200q, want the input truncated as %q", errOut.String(), want)
+	}
+}
+
+// TestQuotePath verifies each quoting style escapes commas, quotes, and backslashes.
+func TestQuotePath(t *testing.T) {
+	cases := []struct {
+		style string
+		input string
+		want  string
+	}{
+		{style: "shell", input: "/a,b", want: `'/a,b'`},
+		{style: "shell", input: `/a'b`, want: `'/a'\''b'`},
+		{style: "shell", input: `/a\b`, want: `'/a\b'`},
+		{style: "csv", input: "/a,b", want: `"/a,b"`},
+		{style: "csv", input: `/a"b`, want: `"/a""b"`},
+		{style: "csv", input: `/a\b`, want: `/a\b`},
+		{style: "json", input: "/a,b", want: `"/a,b"`},
+		{style: "json", input: `/a"b`, want: `"/a\"b"`},
+		{style: "json", input: `/a\b`, want: `"/a\\b"`},
+		{style: "c", input: "/a,b", want: `"/a,b"`},
+		{style: "c", input: `/a"b`, want: `"/a\"b"`},
+		{style: "c", input: `/a\b`, want: `"/a\\b"`},
+		{style: "c", input: "/a\x01b", want: `"/a\001b"`},
+	}
+
+	for _, tc := range cases {
+		got := quotePath(tc.input, tc.style)
+		if got != tc.want {
+			t.Fatalf("quotePath(%q, %q) = %q, want %q", tc.input, tc.style, got, tc.want)
+		}
+	}
+}
+
+// TestRunDashReadsStdin verifies "-" reads stdin in place unless --literal-dash is set.
+func TestRunDashReadsStdin(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"a/./b", "-", "c//d"}, strings.NewReader("x/../y\nz/\n"), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "a/b\ny\nz\nc/d\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	code = run([]string{"--literal-dash", "a/./b", "-"}, strings.NewReader("x/../y\n"), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want = "a/b\n-\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestRunRelPairs verifies symlink targets are relativized from the link's directory.
+func TestRunRelPairs(t *testing.T) {
+	var out, errOut strings.Builder
+	in := "/srv/lib/libfoo.so.1\t/srv/build/out/libfoo.so\nlib/a\tlib/b\n"
+	code := run([]string{"--rel-pairs", "-b", "/srv", "-i"}, strings.NewReader(in), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "../../lib/libfoo.so.1\na\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"--rel-pairs", "no-tab"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1", code)
+	}
+	if !strings.Contains(errOut.String(), "target<TAB>linkpath") {
+		t.Fatalf("stderr did not report malformed pair, got %q", errOut.String())
+	}
+}
+
+// TestRunLogFile verifies verbose logs go to the log file and not stderr.
+func TestRunLogFile(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "trace.log")
+	var out, errOut strings.Builder
+	code := run([]string{"--log-file", logPath, "a//b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "a/b\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "a/b\n")
+	}
+	if errOut.Len() != 0 {
+		t.Fatalf("expected no stderr output, got %q", errOut.String())
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := formatLogLine("initial", "a//b", "") + "\n" +
+		formatLogLine("clean", "a//b", "a/b") + "\n" +
+		formatLogLine("final", "a/b", "") + "\n"
+	if string(data) != want {
+		t.Fatalf("log file = %q, want %q", data, want)
+	}
+}
+
+// TestRunMaxCount verifies processing stops after N paths with the limit exit code.
+func TestRunMaxCount(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--max-count", "2", "-i"}, strings.NewReader("a\nb\nc\nd\n"), &out, &errOut)
+	if code != exitMaxCount {
+		t.Fatalf("run returned exit code %d, want %d", code, exitMaxCount)
+	}
+	if out.String() != "a\nb\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "a\nb\n")
+	}
+	if !strings.Contains(errOut.String(), "--max-count") {
+		t.Fatalf("stderr did not report the limit, got %q", errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"--max-count", "2", "a", "b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+}
+
+// TestHomeSources verifies the first non-empty home source is used for tilda expansion.
+func TestHomeSources(t *testing.T) {
+	t.Setenv("CLEANPATH_EMPTY_HOME", "")
+	t.Setenv("CLEANPATH_ALT_HOME", "/alt/home")
+	opts := options{
+		tildeExpand: true,
+		homeSources: "env:CLEANPATH_EMPTY_HOME,env:CLEANPATH_ALT_HOME,passwd",
+	}
+	if err := prepareOptions(&opts); err != nil {
+		t.Fatalf("prepareOptions returned error: %v", err)
+	}
+
+	got, err := transformPath("~/docs", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "/alt/home/docs" {
+		t.Fatalf("transformPath home sources = %q, want %q", got, "/alt/home/docs")
+	}
+
+	bad := options{homeSources: "env:,bogus"}
+	if err := prepareOptions(&bad); err == nil {
+		t.Fatalf("prepareOptions accepted invalid --home-sources")
+	}
+}
+
+// TestSiblingDot verifies only same-directory relative results gain a ./ prefix.
+func TestSiblingDot(t *testing.T) {
+	cases := map[string]string{
+		"/tmp/some-dir/file":     "./file",
+		"/tmp/some-dir/sub/file": "sub/file",
+		"/tmp/file":              "../file",
+		"/tmp/some-dir":          ".",
+	}
+
+	for input, want := range cases {
+		opts := options{
+			unabsolute:  true,
+			siblingDot:  true,
+			baseAbs:     "/tmp/some-dir",
+			unlimitedUp: true,
+		}
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) sibling dot = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestPreferRelative verifies descendants become relative and other paths stay absolute.
+func TestPreferRelative(t *testing.T) {
+	cases := map[string]string{
+		"/tmp/some-dir/a/b":   "a/b",
+		"a/b":                 "a/b",
+		"/tmp/some-dir":       ".",
+		"/tmp/other/c":        "/tmp/other/c",
+		"../other/c":          "/tmp/other/c",
+		"/tmp/some-dir-2/x/y": "/tmp/some-dir-2/x/y",
+	}
+
+	for input, want := range cases {
+		opts := options{
+			preferRel: true,
+			baseAbs:   "/tmp/some-dir",
+		}
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want || strings.Contains(got, "..") {
+			t.Fatalf("transformPath(%q) prefer relative = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestDecodePercent verifies decoded separators participate in cleaning.
+func TestDecodePercent(t *testing.T) {
+	cases := map[string]string{
+		"a%2F..%2Fb":  "b",
+		"a%2f.%2fb":   "a/b",
+		"a%20b/%zz/c": "a b/%zz/c",
+		"a/b%":        "a/b%",
+	}
+
+	for input, want := range cases {
+		got, err := transformPath(input, options{decodePercent: true})
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) decode percent = %q, want %q", input, got, want)
+		}
+	}
+
+	got, err := transformPath("a%2F..%2Fb", options{})
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "a%2F..%2Fb" {
+		t.Fatalf("transformPath without --decode-percent = %q, want %q", got, "a%2F..%2Fb")
+	}
+}
+
+// TestRunAncestors verifies parent chains are emitted top-down and deduplicated.
+func TestRunAncestors(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--ancestors", "/a/b/c", "/a/b/d/", "x/y", "/"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "/a\n/a/b\n/a/b/c\n/a/b/d\nx\nx/y\n/\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestRootMarker verifies only direct children of the base are marked.
+func TestRootMarker(t *testing.T) {
+	cases := map[string]string{
+		"/tmp/some-dir/a":   "@a",
+		"/tmp/some-dir/a/b": "a/b",
+		"/tmp/some-dir":     ".",
+		"/tmp/other":        "../other",
+	}
+
+	for input, want := range cases {
+		opts := options{
+			unabsolute:  true,
+			rootMarker:  "@",
+			baseAbs:     "/tmp/some-dir",
+			unlimitedUp: true,
+		}
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) root marker = %q, want %q", input, got, want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--root-marker", "@", "foo"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "option --root-marker requires -A or --prefer-relative") {
+		t.Fatalf("run without -A = %d, %q, want the --root-marker error", code, errOut.String())
+	}
+	out.Reset()
+	code = run([]string{"--root-marker", "@", "--prefer-relative", "-b", "/tmp/some-dir", "/tmp/some-dir/a"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "@a\n" {
+		t.Fatalf("run with --prefer-relative = %d, %q, want %q", code, out.String(), "@a\n")
+	}
+}
+
+// TestEnvWithin verifies env expansion only applies under the configured prefix.
+func TestEnvWithin(t *testing.T) {
+	t.Setenv("X", "value")
+	opts := options{
+		envExpand: true,
+		envNames:  []string{"X"},
+		envWithin: "/config/",
+	}
+	if err := prepareOptions(&opts); err != nil {
+		t.Fatalf("prepareOptions returned error: %v", err)
+	}
+
+	cases := map[string]string{
+		"/config/$X":        "/config/value",
+		"/config/./a/${X}":  "/config/a/value",
+		"/data/$X":          "/data/$X",
+		"/configuration/$X": "/configuration/$X",
+	}
+	for input, want := range cases {
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) env within = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestRunLastStage verifies the last effective stage is reported per path.
+func TestRunLastStage(t *testing.T) {
+	t.Setenv("CLEANPATH_STAGE", "env-value")
+	var out, errOut strings.Builder
+	args := []string{"--last-stage", "-e", "-x", "CLEANPATH_STAGE", "-o", "zz", "-n", "z", "a//b", "a/zz", "$CLEANPATH_STAGE", "a/b"}
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "a/b\tclean\na/z\tregex\nenv-value\tenv\na/b\tnone\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestSymlinkMap verifies ".." follows a mapped symlink to its target's parent.
+func TestSymlinkMap(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "links")
+	content := "# link -> target\n/a/b -> /x/y/z\n/a/rel -> ../c/d\n/loop -> /loop\n"
+	if err := os.WriteFile(mapFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{symlinkMap: mapFile, base: "/"}
+	if err := prepareOptions(&opts); err != nil {
+		t.Fatalf("prepareOptions returned error: %v", err)
+	}
+
+	cases := map[string]string{
+		"/a/b/../q":     "/x/y/q",
+		"/a/b/file":     "/x/y/z/file",
+		"/a/rel/../e":   "/c/e",
+		"/a/other/../q": "/a/q",
+	}
+	for input, want := range cases {
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) symlink map = %q, want %q", input, got, want)
+		}
+	}
+
+	if _, err := transformPath("/loop/x", opts); err == nil {
+		t.Fatalf("transformPath did not report a symlink loop")
+	}
+}
+
+// TestTargetOS verifies separators differ per target OS while case is kept in the output
+// and only folded when paths are compared.
+func TestTargetOS(t *testing.T) {
+	cases := map[string]string{
+		"linux":   "/Src/App/Main.go",
+		"windows": `\Src\App\Main.go`,
+		"darwin":  "/Src/App/Main.go",
+	}
+
+	for targetOS, want := range cases {
+		got, err := transformPath("/Src/./App/Main.go", options{targetOS: targetOS})
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath target os %s = %q, want %q", targetOS, got, want)
+		}
+	}
+
+	unique := map[string]string{
+		"linux":   "/Src/A\n/src/a\n",
+		"windows": "\\Src\\A\n",
+		"darwin":  "/Src/A\n",
+	}
+	for targetOS, want := range unique {
+		var out, errOut strings.Builder
+		args := []string{"-q", "--target-os", targetOS, "/Src/A", "/src/a"}
+		if code := run(args, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != want {
+			t.Fatalf("run(%q) = %d, %q, want %q", args, code, out.String(), want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	args := []string{"-i", "--compare-pairs", "--target-os", "darwin"}
+	if code := run(args, strings.NewReader("/Src/A\t/src/a\n/a\t/b\n"), &out, &errOut); code != 4 || out.String() != "/a\t/b\n" {
+		t.Fatalf("run(%q) = %d, %q, want only the differing pair", args, code, out.String())
+	}
+}
+
+// TestCleanEnvValues verifies cleaned values do not add a clean step to the log.
+func TestCleanEnvValues(t *testing.T) {
+	t.Setenv("APP", "/opt/./app/")
+	allowed := map[string]struct{}{"APP": {}}
+
+	opts := options{envExpand: true, envAllowed: allowed, cleanEnvVals: true}
+	_, logs, err := transformPathVerbose("$APP/bin", opts)
+	if err != nil {
+		t.Fatalf("transformPathVerbose returned error: %v", err)
+	}
+	for _, step := range logs {
+		if step.name == "clean" {
+			t.Fatalf("clean step changed an already-canonical path: %q -> %q", step.from, step.to)
+		}
+	}
+}
+
+// TestCleanEnvValuesVariant verifies values are cleaned with the clean step's separator and
+// variant, not always with "/".
+func TestCleanEnvValuesVariant(t *testing.T) {
+	t.Setenv("V", "a/./b")
+	var out, errOut strings.Builder
+	args := []string{"--sep", ":", "-e", "-x", "V", "--clean-env-values", "$V:c"}
+	if code := run(args, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "a/./b:c\n" {
+		t.Fatalf("run(%q) = %d, %q (stderr %q), want %q", args, code, out.String(), errOut.String(), "a/./b:c\n")
+	}
+
+	t.Setenv("V", `C:\x\.\y\..\z`)
+	allowed := map[string]struct{}{"V": {}}
+	opts := options{envExpand: true, envAllowed: allowed, cleanEnvVals: true, windows: true, sep: `\`}
+	_, logs, err := transformPathVerbose(`$V\w`, opts)
+	if err != nil {
+		t.Fatalf("transformPathVerbose returned error: %v", err)
+	}
+	for _, step := range logs {
+		if step.name == "env" && step.to != `C:\x\z\w` {
+			t.Fatalf("env step with -w = %q, want %q", step.to, `C:\x\z\w`)
+		}
+	}
+}
+
+// TestPrependAppend verifies literal prefixes and suffixes wrap the final path.
+func TestPrependAppend(t *testing.T) {
+	opts := options{prepend: "file://", appendStr: "/"}
+	got, logs, err := transformPathVerbose("/a/./b/", opts)
+	if err != nil {
+		t.Fatalf("transformPathVerbose returned error: %v", err)
+	}
+	if got != "file:///a/b/" {
+		t.Fatalf("transformPathVerbose prepend/append = %q, want %q", got, "file:///a/b/")
+	}
+	if lastStage(logs) != "append" {
+		t.Fatalf("last stage = %q, want %q", lastStage(logs), "append")
+	}
+
+	got, err = transformPath("/a/./b/", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "file:///a/b/" {
+		t.Fatalf("transformPath prepend/append = %q, want %q", got, "file:///a/b/")
+	}
+}
+
+// TestCleanpathVarsEnv verifies CLEANPATH_VARS is used only when no -x is given.
+func TestCleanpathVarsEnv(t *testing.T) {
+	t.Setenv("CLEANPATH_VARS", "A, B")
+	t.Setenv("A", "alpha")
+	t.Setenv("B", "beta")
+
+	opts := options{envExpand: true}
+	if err := prepareOptions(&opts); err != nil {
+		t.Fatalf("prepareOptions returned error: %v", err)
+	}
+	got, err := transformPath("$A/$B/$HOME", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "alpha/beta/$HOME" {
+		t.Fatalf("transformPath with CLEANPATH_VARS = %q, want %q", got, "alpha/beta/$HOME")
+	}
+
+	opts = options{envExpand: true, envNames: []string{"B"}}
+	if err := prepareOptions(&opts); err != nil {
+		t.Fatalf("prepareOptions returned error: %v", err)
+	}
+	got, err = transformPath("$A/$B", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "$A/beta" {
+		t.Fatalf("transformPath with explicit -x = %q, want %q", got, "$A/beta")
+	}
+}
+
+// TestRunComparePairs verifies only differing pairs are emitted and the exit code reflects them.
+func TestRunComparePairs(t *testing.T) {
+	var out, errOut strings.Builder
+	in := "a/./b\ta//b\n/x/../y\t/y/\n"
+	code := run([]string{"--compare-pairs", "-i"}, strings.NewReader(in), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected no output for matching pairs, got %q", out.String())
+	}
+
+	out.Reset()
+	in = "a/./b\ta//b\nc/d\tc/e/..\nc/d\tc/e\n"
+	code = run([]string{"--compare-pairs", "-v", "-i"}, strings.NewReader(in), &out, &errOut)
+	if code != exitPairsDiffer {
+		t.Fatalf("run returned exit code %d, want %d", code, exitPairsDiffer)
+	}
+	if out.String() != "c/d\tc\nc/d\tc/e\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "c/d\tc\nc/d\tc/e\n")
+	}
+	if !strings.Contains(errOut.String(), formatLogLine("differ", "c/d", "c/e")) {
+		t.Fatalf("stderr did not label the differing pair, got %q", errOut.String())
+	}
+}
+
+// TestRunCompareResolution verifies the final path, made absolute against the base, reports
+// differing resolutions through a symlink, including a ".." kept by --slashes-only.
+func TestRunCompareResolution(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "real", "inner")
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	cases := []struct {
+		args       []string
+		wantOut    string
+		wantStderr string
+	}{
+		{
+			args:       []string{"--compare-resolution", dir + "/link", dir + "/real"},
+			wantOut:    dir + "/link\n" + dir + "/real\n",
+			wantStderr: "cleanpath: " + dir + "/link: logical " + dir + "/link, physical " + dir + "/real/inner\n",
+		},
+		{
+			args:       []string{"--compare-resolution", "-b", dir, "link"},
+			wantOut:    "link\n",
+			wantStderr: "cleanpath: link: logical " + dir + "/link, physical " + dir + "/real/inner\n",
+		},
+		{
+			// The default clean removes "link/..", so there is nothing left to resolve.
+			args:    []string{"--compare-resolution", dir + "/link/.."},
+			wantOut: dir + "\n",
+		},
+		{
+			args:       []string{"--compare-resolution", "--slashes-only", dir + "/link/.."},
+			wantOut:    dir + "/link/..\n",
+			wantStderr: "cleanpath: " + dir + "/link/..: logical " + dir + ", physical " + dir + "/real\n",
+		},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 || out.String() != tc.wantOut || errOut.String() != tc.wantStderr {
+			t.Fatalf("run(%q) = %d, %q, stderr %q, want 0, %q, stderr %q", tc.args, code, out.String(), errOut.String(), tc.wantOut, tc.wantStderr)
+		}
+	}
+}
+
+// TestExpandTildeConcurrent verifies cached ~user lookups are safe and ordered under concurrency.
+func TestExpandTildeConcurrent(t *testing.T) {
+	current, err := user.Current()
+	if err != nil || current.HomeDir == "" {
+		t.Skipf("current user unavailable: %v", err)
+	}
+	opts := options{tildeExpand: true}
+
+	inputs := make([]string, 200)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("~%s/f%d", current.Username, i)
+	}
+	results := make([]string, len(inputs))
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = transformPath(input, opts)
+		}()
+	}
+	wg.Wait()
+
+	for i, got := range results {
+		want := cleanpath.Clean(fmt.Sprintf("%s/f%d", current.HomeDir, i))
+		if got != want {
+			t.Fatalf("result %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestRunJobs verifies --jobs expands many ~user inputs on several workers and still
+// writes the results in input order, matching a sequential run.
+func TestRunJobs(t *testing.T) {
+	current, err := user.Current()
+	if err != nil || current.HomeDir == "" {
+		t.Skipf("current user unavailable: %v", err)
+	}
+
+	args := []string{"-t", "--brace-expand"}
+	var want strings.Builder
+	for i := range 200 {
+		args = append(args, fmt.Sprintf("~%s/d%d/./{a,b}", current.Username, i))
+		for _, leaf := range []string{"a", "b"} {
+			fmt.Fprintf(&want, "%s\n", cleanpath.Clean(fmt.Sprintf("%s/d%d/%s", current.HomeDir, i, leaf)))
+		}
+	}
+
+	for _, jobs := range []string{"1", "8"} {
+		var out, errOut strings.Builder
+		code := run(append([]string{"--jobs", jobs}, args...), strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run --jobs %s returned exit code %d (stderr: %q)", jobs, code, errOut.String())
+		}
+		if out.String() != want.String() {
+			t.Fatalf("run --jobs %s output differs from input order:\n%s", jobs, out.String())
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--jobs", "-1", "a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --jobs -1 returned exit code %d, want 1", code)
+	}
+}
+
+// TestCustomSeparator verifies relativizing with non-slash separators.
+func TestCustomSeparator(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--sep", ":", "-A", "-p", "1", "-b", ":root:keys", ":root:keys:a", ":root:other"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "a\n..:other\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "a\n..:other\n")
+	}
+}
+
+// TestRunSeparatorAwareOptions verifies --ancestors, --sibling-dot, --root-marker, and
+// --rel-pairs split on --sep, and on \ and drive or UNC roots with -w.
+func TestRunSeparatorAwareOptions(t *testing.T) {
+	cases := []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{args: []string{"--sep", ":", "--ancestors", ":a:b:c"}, want: ":a\n:a:b\n:a:b:c\n"},
+		{args: []string{"--sep", "|", "--ancestors", "x|y"}, want: "x\nx|y\n"},
+		{args: []string{"--sep", ":", "--sibling-dot", "a", "a:b"}, want: ".:a\na:b\n"},
+		{args: []string{"--sep", ":", "-A", "-b", ":a", "--root-marker", "@", "x:y", ":a:x"}, want: "x:y\n@x\n"},
+		{args: []string{"--sep", ":", "--rel-pairs", "-b", ":r", "-"}, stdin: ":r:lib:x\t:r:bin:link\n", want: "..:lib:x\n"},
+		{args: []string{"-w", "--ancestors", `C:\a\b`, `\\srv\share\a\b`, `C:a\b`}, want: "C:\\a\nC:\\a\\b\n\\\\srv\\share\\a\n\\\\srv\\share\\a\\b\nC:a\nC:a\\b\n"},
+		{args: []string{"-w", "--sibling-dot", "a", "C:a"}, want: ".\\a\nC:a\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(tc.stdin), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+}
+
+// TestRunRelativeToAll verifies one column per root, blank where the root does not contain the path.
+func TestRunRelativeToAll(t *testing.T) {
+	var out, errOut strings.Builder
+	args := []string{"--relative-to-all", "-b", "/repo/svc", "-b", "/repo/lib", "/repo/svc/api/main.go", "/repo/lib/x", "/repo/svc"}
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "api/main.go\t\n\tx\n.\t\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestRunOnlyExisting verifies existence filtering, including a dangling symlink.
+func TestRunOnlyExisting(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dangling := filepath.Join(dir, "dangling")
+	if err := os.Symlink(filepath.Join(dir, "nowhere"), dangling); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	cases := []struct {
+		flags []string
+		want  string
+	}{
+		{flags: []string{"--only-existing"}, want: file + "\n" + dangling + "\n"},
+		{flags: []string{"--only-existing", "--follow-symlinks"}, want: file + "\n"},
+		{flags: []string{"--only-missing"}, want: missing + "\n"},
+		{flags: []string{"--only-missing", "--follow-symlinks"}, want: dangling + "\n" + missing + "\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		args := append(tc.flags, file, dangling, missing)
+		code := run(args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("%v: run returned exit code %d, want 0 (stderr: %q)", tc.flags, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("%v: run output = %q, want %q", tc.flags, out.String(), tc.want)
+		}
+	}
+}
+
+// TestTildeUnexpandLongestHome verifies the longest matching home wins among candidates.
+func TestTildeUnexpandLongestHome(t *testing.T) {
+	opts := options{
+		tildeUnexpand: true,
+		resolvedHome:  "/home/me",
+		extraHomes:    []cleanpath.Home{{Dir: "/home/me/svc", Prefix: "~svc"}},
+	}
+
+	cases := map[string]string{
+		"/home/me/svc/data": "~svc/data",
+		"/home/me/svc":      "~svc",
+		"/home/me/docs":     "~/docs",
+		"/home/me/svc2":     "~/svc2",
+		"/srv/other":        "/srv/other",
+	}
+	for input, want := range cases {
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) longest home = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestRunLogTSV verifies tab-separated verbose lines with empty fields for initial/final.
+func TestRunLogTSV(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--log-tsv", "a/./b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "initial\ta/./b\t\nclean\ta/./b\ta/b\nfinal\ta/b\t\n"
+	if errOut.String() != want {
+		t.Fatalf("stderr = %q, want %q", errOut.String(), want)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(errOut.String(), "\n"), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) != 3 {
+			t.Fatalf("log line %q has %d fields, want 3", line, len(fields))
+		}
+	}
+}
+
+// TestMaxUp verifies leading parents beyond the limit are dropped after cleaning.
+func TestMaxUp(t *testing.T) {
+	cases := []struct {
+		limit string
+		input string
+		want  string
+	}{
+		{limit: "1", input: "../../../a", want: "../a"},
+		{limit: "1", input: "../a/../../b", want: "../b"},
+		{limit: "2", input: "../a", want: "../a"},
+		{limit: "0", input: "../..", want: "."},
+		{limit: "0", input: "/../a", want: "/a"},
+	}
+	for _, tc := range cases {
+		opts := options{maxUpRaw: tc.limit}
+		if err := prepareOptions(&opts); err != nil {
+			t.Fatalf("prepareOptions returned error: %v", err)
+		}
+		got, err := transformPath(tc.input, opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != tc.want {
+			t.Fatalf("transformPath(%q) --max-up %s = %q, want %q", tc.input, tc.limit, got, tc.want)
+		}
+	}
+}
+
+// TestEnvExpandThenClean verifies expanded values are cleaned together with the ".." around them.
+func TestEnvExpandThenClean(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("SHARED", "../shared/")
+	var out, errOut strings.Builder
+	code := run([]string{"-e", "-x", "HOME", "-x", "SHARED", "$HOME/../shared/x", "${HOME}/$SHARED/./y"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "/home/shared/x\n/home/shared/y\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestEnvDefaultsCompose verifies a ${VAR:-WORD} default that references another variable
+// is expanded before cleaning, so its ".." climbs from the substituted value, and that a
+// leading ~ in the WORD is expanded with -t.
+func TestEnvDefaultsCompose(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("CLEANPATH_TEST_DIR", "")
+	os.Unsetenv("CLEANPATH_TEST_DIR")
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-e", "-x", "CLEANPATH_TEST_DIR", "-x", "HOME", "${CLEANPATH_TEST_DIR:-$HOME/../shared}/x"}, want: "/home/shared/x\n"},
+		{args: []string{"-e", "-x", "CLEANPATH_TEST_DIR", "-x", "HOME", "${CLEANPATH_TEST_DIR:-${HOME}}/y"}, want: "/home/me/y\n"},
+		{args: []string{"-e", "-x", "CLEANPATH_TEST_DIR", "-x", "HOME", "${CLEANPATH_TEST_DIR:-${HOME}/x}/y"}, want: "/home/me/x/y\n"},
+		{args: []string{"-e", "-x", "HOME", "${HOME:+$HOME/../alt}/q"}, want: "/home/alt/q\n"},
+		{args: []string{"-e", "${CLEANPATH_TEST_DIR:-$HOME/../shared}/x"}, want: "/home/shared/x\n"},
+		{args: []string{"-e", "-t", "--home-sources", "env:HOME", "${CLEANPATH_TEST_DIR:-~/../shared}/x"}, want: "/home/shared/x\n"},
+		{args: []string{"-e", "-t", "--home-sources", "env:HOME", "--slashes-only", "${CLEANPATH_TEST_DIR:-~/../shared}/x"}, want: "/home/me/../shared/x\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 || out.String() != tc.want {
+			t.Fatalf("run(%q) = %d, %q (stderr %q), want %q", tc.args, code, out.String(), errOut.String(), tc.want)
+		}
+	}
+}
+
+// TestRunRelativeStrict verifies paths beyond the parent limit fail instead of passing through.
+func TestRunRelativeStrict(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"-A", "-b", "/tmp/some-dir", "-p", "1", "--relative-strict", "/tmp/foo"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "../foo\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "../foo\n")
+	}
+
+	out.Reset()
+	code = run([]string{"-A", "-b", "/tmp/some-dir", "--relative-strict", "/tmp/foo", "/tmp/some-dir/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1", code)
+	}
+	if out.String() != "x\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "x\n")
+	}
+	if !strings.Contains(errOut.String(), "cleanpath: /tmp/foo: cannot relativize") {
+		t.Fatalf("stderr did not report the failed path, got %q", errOut.String())
+	}
+}
+
+// TestTransformTrimSpace verifies segments are trimmed and whitespace-only segments dropped.
+func TestTransformTrimSpace(t *testing.T) {
+	cases := map[string]string{
+		" a / b ":          "a/b",
+		" / my dir /  / x": "/my dir/x",
+		"a/   /b":          "a/b",
+		"   ":              ".",
+	}
+	for input, want := range cases {
+		got, err := transformPath(input, options{trimSpace: true})
+		if err != nil {
+			t.Fatalf("transformPath(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) = %q, want %q", input, got, want)
+		}
+		got, _, err = transformPathVerbose(input, options{trimSpace: true})
+		if err != nil || got != want {
+			t.Fatalf("transformPathVerbose(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+
+	got, err := transformPath(" a / b ", options{})
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != " a / b " {
+		t.Fatalf("transformPath without --trim-space = %q, want spaces kept", got)
+	}
+}
+
+// TestRunMaxSymlinkDepth verifies the symlink hop limit is configurable and stops map cycles.
+func TestRunMaxSymlinkDepth(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "links")
+	content := "/a -> /b\n/b -> /c\n/c -> /a\n/one -> /two\n/two -> /three\n"
+	if err := os.WriteFile(mapFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--symlink-map", mapFile, "--max-symlink-depth", "5", "/a/x", "/one/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1", code)
+	}
+	if out.String() != "/three/x\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/three/x\n")
+	}
+	if !strings.Contains(errOut.String(), "cleanpath: /a/x: too many levels of symbolic links (limit 5)") {
+		t.Fatalf("stderr did not report the cycle, got %q", errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"--symlink-map", mapFile, "--max-symlink-depth", "1", "/one/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 || out.String() != "" {
+		t.Fatalf("run with depth 1 = %d, %q, want exit 1 and no output", code, out.String())
+	}
+
+	for _, args := range [][]string{
+		{"--max-symlink-depth", "3", "/a"},
+		{"--symlink-map", mapFile, "--max-symlink-depth", "-1", "/a"},
+	} {
+		errOut.Reset()
+		if code := run(args, strings.NewReader(""), &out, &errOut); code != 1 {
+			t.Fatalf("run(%q) returned exit code %d, want 1", args, code)
+		}
+	}
+}
+
+// TestTransformTop verifies --top keeps the leading segments and the root.
+func TestTransformTop(t *testing.T) {
+	cases := []struct {
+		input string
+		top   int
+		want  string
+	}{
+		{input: "/a/b/c/d", top: 2, want: "/a/b"},
+		{input: "a/./b/c", top: 2, want: "a/b"},
+		{input: "a/b", top: 3, want: "a/b"},
+		{input: "../../x/y", top: 1, want: ".."},
+		{input: "/", top: 1, want: "/"},
+	}
+	for _, tc := range cases {
+		got, err := transformPath(tc.input, options{top: tc.top})
+		if err != nil {
+			t.Fatalf("transformPath(%q) returned error: %v", tc.input, err)
+		}
+		if got != tc.want {
+			t.Fatalf("transformPath(%q) --top %d = %q, want %q", tc.input, tc.top, got, tc.want)
+		}
+	}
+}
+
+// TestExpandTildeHomeFallback verifies ~ expands to the fallback only when no home is resolved.
+func TestExpandTildeHomeFallback(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_EMPTY_HOME", "")
+	opts := options{tildeExpand: true, homeSources: "env:CLEANPATH_TEST_EMPTY_HOME", homeFallback: "/nonexistent/"}
+	if err := prepareOptions(&opts); err != nil {
+		t.Fatalf("prepareOptions returned error: %v", err)
+	}
+	if opts.resolvedHome != "" {
+		t.Fatalf("resolvedHome = %q, want empty", opts.resolvedHome)
+	}
+	got, err := transformPath("~/x", opts)
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "/nonexistent/x" {
+		t.Fatalf("transformPath with fallback = %q, want %q", got, "/nonexistent/x")
+	}
+
+	opts.homeFallback = ""
+	if got := cleanpath.ExpandTilde("~/x", opts.libOptions()); got != "~/x" {
+		t.Fatalf("cleanpath.ExpandTilde without fallback = %q, want %q", got, "~/x")
+	}
+
+	opts = options{tildeExpand: true, resolvedHome: "/home/me", homeFallback: "/nonexistent"}
+	if got := cleanpath.ExpandTilde("~/x", opts.libOptions()); got != "/home/me/x" {
+		t.Fatalf("cleanpath.ExpandTilde with a resolved home = %q, want %q", got, "/home/me/x")
+	}
+}
+
+// TestRunReportWasAbsolute verifies the column reflects the raw input, not the -a result.
+func TestRunReportWasAbsolute(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"-a", "-b", "/base", "--report-was-absolute", "/x/../y", "rel/z"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "/y\ttrue\n/base/rel/z\tfalse\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestTransformHomeToEnv verifies the home prefix becomes $HOME only on a segment boundary.
+func TestTransformHomeToEnv(t *testing.T) {
+	opts := options{homeToEnv: true, resolvedHome: "/home/me"}
+	cases := map[string]string{
+		"/home/me/x":   "$HOME/x",
+		"/home/me":     "$HOME",
+		"/home/meta/x": "/home/meta/x",
+		"/srv/home/me": "/srv/home/me",
+	}
+	for input, want := range cases {
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) --home-to-env = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestTransformNoCleanAbsolute verifies the raw base join is kept only with --no-clean-absolute.
+func TestTransformNoCleanAbsolute(t *testing.T) {
+	cases := []struct {
+		opts options
+		want string
+	}{
+		{opts: options{absolute: true, baseAbs: "/a/b"}, want: "/a/x"},
+		{opts: options{absolute: true, baseAbs: "/a/b", noCleanAbs: true}, want: "/a/b/../x"},
+		{opts: options{absolute: true, baseAbs: "/", noCleanAbs: true}, want: "/../x"},
+	}
+	for _, tc := range cases {
+		got, err := transformPath("./../x", tc.opts)
+		if err != nil {
+			t.Fatalf("transformPath returned error: %v", err)
+		}
+		if got != tc.want {
+			t.Fatalf("transformPath with base %q = %q, want %q", tc.opts.baseAbs, got, tc.want)
+		}
+	}
+}
+
+// TestRunDetectCaseCollisions verifies paths equal under case folding are reported with exit 5.
+func TestRunDetectCaseCollisions(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--detect-case-collisions", "/a/Foo", "/a/./foo", "/a/Foo", "/a/bar"}, strings.NewReader(""), &out, &errOut)
+	if code != exitCaseCollision {
+		t.Fatalf("run returned exit code %d, want %d", code, exitCaseCollision)
+	}
+	if out.String() != "/a/Foo\n/a/foo\n/a/Foo\n/a/bar\n" {
+		t.Fatalf("run output = %q, want every path", out.String())
+	}
+	if errOut.String() != "cleanpath: case collision: /a/Foo and /a/foo\n" {
+		t.Fatalf("stderr = %q, want one collision", errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"--detect-case-collisions", "/a/Foo", "/a/Foo", "/b/foo"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || errOut.String() != "" {
+		t.Fatalf("run without collisions = %d, stderr %q, want 0 and no report", code, errOut.String())
+	}
+}
+
+// TestTransformIncludeBaseName verifies -A keeps the base's last component when asked.
+func TestTransformIncludeBaseName(t *testing.T) {
+	cases := []struct {
+		input    string
+		withName bool
+		want     string
+	}{
+		{input: "/tmp/some-dir/a", want: "a"},
+		{input: "/tmp/some-dir/a", withName: true, want: "some-dir/a"},
+		{input: "/tmp/some-dir", withName: true, want: "some-dir"},
+		{input: "/tmp/other/b", withName: true, want: "other/b"},
+		{input: "rel/c", withName: true, want: "rel/c"},
+	}
+	for _, tc := range cases {
+		opts := options{unabsolute: true, baseAbs: "/tmp/some-dir", parentLimit: 1, sep: "/", withBaseName: tc.withName}
+		got, err := transformPath(tc.input, opts)
+		if err != nil {
+			t.Fatalf("transformPath(%q) returned error: %v", tc.input, err)
+		}
+		if got != tc.want {
+			t.Fatalf("transformPath(%q) include-base-name=%v = %q, want %q", tc.input, tc.withName, got, tc.want)
+		}
+		got, _, err = transformPathVerbose(tc.input, opts)
+		if err != nil || got != tc.want {
+			t.Fatalf("transformPathVerbose(%q) = %q, %v, want %q", tc.input, got, err, tc.want)
+		}
+	}
+}
+
+// TestFormatTable verifies columns are padded to the widest cell.
+func TestFormatTable(t *testing.T) {
+	rows := [][]string{
+		{"INPUT", "OUTPUT", "STEPS"},
+		{"a/./b", "a/b", "clean"},
+		{"/very/long/../input", "/very/input", "clean"},
+		{"x", "x", "none"},
+	}
+	want := []string{
+		"INPUT               | OUTPUT      | STEPS",
+		"a/./b               | a/b         | clean",
+		"/very/long/../input | /very/input | clean",
+		"x                   | x           | none",
+	}
+	got := formatTable(rows)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("formatTable = %q, want %q", got, want)
+	}
+}
+
+// TestStepNames verifies the STEPS column lists only the steps that changed a path, and
+// "none" for a path that came through unchanged.
+func TestStepNames(t *testing.T) {
+	for input, want := range map[string]string{"a/b": "none", "a/./b": "clean", "/x/../y/": "clean"} {
+		_, logs, err := transformPathVerbose(input, options{})
+		if err != nil {
+			t.Fatalf("transformPathVerbose(%q) returned error: %v", input, err)
+		}
+		if got := stepNames(logs); got != want {
+			t.Fatalf("stepNames for %q = %q, want %q", input, got, want)
+		}
+	}
+
+	_, logs, err := transformPathVerbose("~/./x", options{tildeExpand: true, resolvedHome: "/home/me"})
+	if err != nil {
+		t.Fatalf("transformPathVerbose returned error: %v", err)
+	}
+	if got := stepNames(logs); got != "tilda,clean" {
+		t.Fatalf("stepNames for ~/./x = %q, want %q", got, "tilda,clean")
+	}
+}
+
+// TestRunTableNonTTY verifies --table falls back to plain output off a terminal.
+func TestRunTableNonTTY(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--table", "a/./b", "/x/../y"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0", code)
+	}
+	if out.String() != "a/b\n/y\n" {
+		t.Fatalf("run output = %q, want plain lines", out.String())
+	}
+}
+
+// TestRunUnexpandAfterRegex verifies a regex-injected home collapses to ~ and is logged.
+func TestRunUnexpandAfterRegex(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_HOME", "/home/me")
+	var out, errOut strings.Builder
+	code := run([]string{"-v", "--home-sources", "env:CLEANPATH_TEST_HOME", "-o", "^/srv/users/me", "-n", "/home/me", "--unexpand-after-regex", "/srv/users/me/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "~/x\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "~/x\n")
+	}
+	if !strings.Contains(errOut.String(), formatLogLine("untilda", "/home/me/x", "~/x")) {
+		t.Fatalf("verbose log did not show the extra untilda step, got %q", errOut.String())
+	}
+}
+
+// TestRunInlineOptions verifies a #cleanpath: header applies flags that the command line can override.
+func TestRunInlineOptions(t *testing.T) {
+	input := "#cleanpath: -a -b /srv --top 2\nx/y/z\n../q\n"
+	var out, errOut strings.Builder
+	code := run([]string{"--allow-inline-options", "-i"}, strings.NewReader(input), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/srv/x\n/q\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/srv/x\n/q\n")
+	}
+
+	out.Reset()
+	code = run([]string{"--allow-inline-options", "-b", "/opt", "-"}, strings.NewReader(input), &out, &errOut)
+	if code != 0 || out.String() != "/opt/x\n/q\n" {
+		t.Fatalf("run with -b override = %d, %q, want 0 and %q", code, out.String(), "/opt/x\n/q\n")
+	}
+
+	out.Reset()
+	code = run([]string{"-i"}, strings.NewReader(input), &out, &errOut)
+	if code != 0 || !strings.HasPrefix(out.String(), "#cleanpath: -a -b /srv --top 2\n") {
+		t.Fatalf("run without --allow-inline-options = %d, %q, want the header as a path", code, out.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"--allow-inline-options", "-i"}, strings.NewReader("#cleanpath: -a extra\nx\n"), &out, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "inline options may only contain flags") {
+		t.Fatalf("run with a path in the header = %d, stderr %q, want a flags-only error", code, errOut.String())
+	}
+}
+
+// TestRunInlineOptionsRefused verifies a #cleanpath: header cannot set flags that open,
+// write, or select files, and that a refused --tee creates nothing.
+func TestRunInlineOptionsRefused(t *testing.T) {
+	dir := t.TempDir()
+	tee := filepath.Join(dir, "tee")
+	cases := map[string]string{
+		"--tee " + tee:                    "--tee",
+		"-a --log-file=" + tee:            "--log-file",
+		"-f /etc/hostname":                "-f",
+		"-af /etc/hostname":               "-f",
+		"--rewrite-file " + tee:           "--rewrite-file",
+		"--symlink-map " + tee:            "--symlink-map",
+		"-e --env-snapshot " + tee:        "--env-snapshot",
+		"--interactive":                   "--interactive",
+		"-i":                              "-i",
+		"--allow-inline-options":          "--allow-inline-options",
+		"-b /srv -o x -n -f --tee=" + tee: "--tee",
+	}
+	for header, flagName := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"--allow-inline-options", "-i"}, strings.NewReader("#cleanpath: "+header+"\nx\n"), &out, &errOut)
+		want := "inline options may not set " + flagName + "\n"
+		if code != 1 || !strings.HasSuffix(errOut.String(), want) {
+			t.Fatalf("run with header %q = %d, stderr %q, want an error naming %s", header, code, errOut.String(), flagName)
+		}
+	}
+	if _, err := os.Stat(tee); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("refused --tee created %s (stat error %v)", tee, err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--allow-inline-options", "-i"}, strings.NewReader("#cleanpath: -ab /srv -o x -n -f\nx/a\n"), &out, &errOut)
+	if code != 0 || out.String() != "/srv/-f/a\n" {
+		t.Fatalf("run with a value that looks like a flag = %d, %q (stderr %q), want %q", code, out.String(), errOut.String(), "/srv/-f/a\n")
+	}
+}
+
+// TestCleanPathPosix verifies cleanPathPosix against the lexical rules of POSIX pathname
+// resolution (XBD 4.13), one group of cases per rule.
+func TestCleanPathPosix(t *testing.T) {
+	cases := []struct {
+		rule  string
+		input string
+		want  string
+	}{
+		// "A pathname consisting of a single <slash> shall resolve to the root directory."
+		{rule: "single slash", input: "/", want: "/"},
+		// "Multiple successive <slash> characters are considered to be the same as one
+		// <slash>, except for the case of exactly two leading <slash> characters."
+		{rule: "successive slashes", input: "a//b", want: "a/b"},
+		{rule: "successive slashes", input: "/a///b", want: "/a/b"},
+		// "If a pathname begins with two successive <slash> characters, the first component
+		// following the leading <slash> characters may be interpreted in an
+		// implementation-defined manner, although more than two leading <slash> characters
+		// shall be treated as a single <slash> character."
+		{rule: "two leading slashes", input: "//", want: "//"},
+		{rule: "two leading slashes", input: "//host/a/../b", want: "//host/b"},
+		{rule: "two leading slashes", input: "//..", want: "//"},
+		{rule: "more than two leading slashes", input: "///", want: "/"},
+		{rule: "more than two leading slashes", input: "////a//b", want: "/a/b"},
+		// "The special filename dot shall refer to the directory specified by its predecessor."
+		{rule: "dot", input: "a/./b", want: "a/b"},
+		{rule: "dot", input: "./a", want: "a"},
+		// "The special filename dot-dot shall refer to the parent directory of its predecessor
+		// directory. As a special case, in the root directory, dot-dot may refer to the root
+		// directory itself."
+		{rule: "dot-dot", input: "/a/b/../c", want: "/a/c"},
+		{rule: "dot-dot", input: "../a", want: "../a"},
+		{rule: "dot-dot in the root", input: "/..", want: "/"},
+		{rule: "dot-dot in the root", input: "/../a", want: "/a"},
+		// "A pathname that contains at least one non-<slash> character and that ends with one
+		// or more trailing <slash> characters shall not be resolved successfully unless the
+		// last pathname component before the trailing <slash> characters names an existing
+		// directory", so the trailing slash is kept whatever the path cleans to.
+		{rule: "trailing slash", input: "a/b/", want: "a/b/"},
+		{rule: "trailing slash", input: "/a//", want: "/a/"},
+		{rule: "trailing slash", input: "//a/", want: "//a/"},
+		{rule: "trailing slash", input: "a/./b/../", want: "a/"},
+		{rule: "trailing slash", input: "/a/b/c/./../../", want: "/a/"},
+		{rule: "trailing slash", input: "../", want: "../"},
+		{rule: "trailing slash", input: "./", want: "./"},
+		{rule: "trailing slash", input: "a/..//", want: "./"},
+		// An empty pathname does not resolve; lexically it cleans to ".", as with Clean.
+		{rule: "empty", input: "", want: "."},
+	}
+	for _, tc := range cases {
+		if got := cleanPathPosix(tc.input); got != tc.want {
+			t.Fatalf("cleanPathPosix(%q) = %q, want %q (%s)", tc.input, got, tc.want, tc.rule)
+		}
+	}
+
+	got, err := transformPath("//host/x/", options{posix: true})
+	if err != nil {
+		t.Fatalf("transformPath returned error: %v", err)
+	}
+	if got != "//host/x/" {
+		t.Fatalf("transformPath --posix = %q, want %q", got, "//host/x/")
+	}
+}
+
+// TestCleanPathKeepDouble verifies runs of slashes cap at // and single slashes clean normally.
+func TestCleanPathKeepDouble(t *testing.T) {
+	cases := map[string]string{
+		"a//b":         "a//b",
+		"a///b":        "a//b",
+		"a/////b/./c":  "a//b/c",
+		"a/b":          "a/b",
+		"//pkg/x/../y": "//pkg/y",
+		"///pkg":       "//pkg",
+		"a//../b":      "a//../b",
+		"a//./b//":     "a//b",
+		"/a/./b":       "/a/b",
+		"//":           "//",
+		"":             ".",
+	}
+	for input, want := range cases {
+		if got := cleanPathKeepDouble(input); got != want {
+			t.Fatalf("cleanPathKeepDouble(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestRunRenameSegment verifies only whole, exact segments are renamed.
+func TestRunRenameSegment(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--rename-segment", "old=new", "--rename-segment", "new=newer", "/a/old/b", "/a/older/b", "old/./x/old", "/a/new"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "/a/new/b\n/a/older/b\nnew/x/new\n/a/newer\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	for _, spec := range []string{"old", "=new", "old=", "a/b=c", "..=up"} {
+		errOut.Reset()
+		if code := run([]string{"--rename-segment", spec, "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+			t.Fatalf("run with --rename-segment %q returned exit code %d, want 1", spec, code)
+		}
+	}
+}
+
+// TestRunNull verifies NUL-delimited records round-trip paths containing newlines.
+func TestRunNull(t *testing.T) {
+	input := "a/./line\nbreak\x00/x/../y\x00last"
+	var out, errOut strings.Builder
+	code := run([]string{"-0", "-i"}, strings.NewReader(input), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "a/line\nbreak\x00/y\x00last\x00"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	errOut.Reset()
+	if code := run([]string{"-0", "a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with -0 and no -i returned exit code %d, want 1", code)
+	}
+	if !strings.Contains(errOut.String(), "option -0 requires -i") {
+		t.Fatalf("stderr did not explain the -0 error, got %q", errOut.String())
+	}
+}
+
+// TestRunNoTrailingNewline verifies the terminator separates results without ending the output.
+func TestRunNoTrailingNewline(t *testing.T) {
+	cases := []struct {
+		args  []string
+		input string
+		want  string
+	}{
+		{args: []string{"--no-trailing-newline", "a/./b", "/x/../y"}, want: "a/b\n/y"},
+		{args: []string{"--no-trailing-newline", "only"}, want: "only"},
+		{args: []string{"--no-trailing-newline", "-0", "-i"}, input: "a//b\x00c\x00", want: "a/b\x00c"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(tc.input), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d, want 0 (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+}
+
+// TestRunReportDepthFromBase verifies signed depths for descendants, the base, and ancestors.
+func TestRunReportDepthFromBase(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"-b", "/a/b", "--report-depth-from-base", "/a/b/c/d", "/a/b", "/a", "/a/x", "c/./d"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "/a/b/c/d\t2\n/a/b\t0\n/a\t-1\n/a/x\t0\nc/d\t2\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestCleanPathWindows verifies drive, UNC, and mixed-separator cleaning.
+func TestCleanPathWindows(t *testing.T) {
+	cases := map[string]string{
+		`C:\foo\..\bar`:          `C:\bar`,
+		`C:/foo\bar`:             `C:\foo\bar`,
+		`C:/foo\bar/..\baz`:      `C:\foo\baz`,
+		`C:\foo\..\..\bar`:       `C:\bar`,
+		`C:\`:                    `C:\`,
+		`c:/..`:                  `c:\`,
+		`C:foo\..\..`:            `C:..`,
+		`\\server\share`:         `\\server\share`,
+		`\\server\share\a\..\..`: `\\server\share`,
+		`//server/share/x/./y/`:  `\\server\share\x\y`,
+		`\a\..\..\b`:             `\b`,
+		`a\.\b\..\..\..\c`:       `..\c`,
+		``:                       `.`,
+	}
+	for input, want := range cases {
+		if got := cleanPathWindows(input); got != want {
+			t.Fatalf("cleanPathWindows(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestCleanPathWindowsMixedSeparators verifies drive paths mixing / and \ collapse across
+// both separators, keep the drive root, and come out with backslashes only.
+func TestCleanPathWindowsMixedSeparators(t *testing.T) {
+	cases := map[string]string{
+		`C:/foo\bar/..\baz`:       `C:\foo\baz`,
+		`c:\a/./b\\c/`:            `c:\a\b\c`,
+		`C:/..\x`:                 `C:\x`,
+		`C:\/a`:                   `C:\a`,
+		`C:foo/..\bar`:            `C:bar`,
+		`D:/a\b/../../..\c`:       `D:\c`,
+		`\\srv/share\a/..\b`:      `\\srv\share\b`,
+		`c:/Program Files\x/./y\`: `c:\Program Files\x\y`,
+	}
+	for input, want := range cases {
+		if got := cleanPathWindows(input); got != want {
+			t.Fatalf("cleanPathWindows(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestRunWindows verifies -w through run, including the was-absolute column.
+func TestRunWindows(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"-w", "--report-was-absolute", `C:/foo\bar/..\baz`, `foo/../bar`, `\\srv\share\x`}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	want := "C:\\foo\\baz\ttrue\nbar\tfalse\n\\\\srv\\share\\x\ttrue\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	errOut.Reset()
+	if code := run([]string{"-w", "-a", `C:\x`}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with -w -a returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunLogOnError verifies steps are logged only for paths that fail.
+func TestRunLogOnError(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(mapFile, []byte("/loop -> /loop\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out, errOut strings.Builder
+	code := run([]string{"--log-on-error", "--log-tsv", "--symlink-map", mapFile, "/ok/./x", "/loop/./y"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1", code)
+	}
+	if out.String() != "/ok/x\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/ok/x\n")
+	}
+	logs := errOut.String()
+	if strings.Contains(logs, "/ok/") {
+		t.Fatalf("logs mention the successful path: %q", logs)
+	}
+	if !strings.Contains(logs, "initial\t/loop/./y\t\n") || !strings.Contains(logs, "cleanpath: /loop/./y: too many levels") {
+		t.Fatalf("logs for the failing path are missing: %q", logs)
+	}
+}
+
+// TestTransformKeepTrailing verifies -k restores one trailing slash judged after expansion.
+func TestTransformKeepTrailing(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_DIR", "/srv/data/")
+	opts := options{keepTrailing: true, sep: "/", envExpand: true, envAllowed: map[string]struct{}{"CLEANPATH_TEST_DIR": {}}}
+	cases := map[string]string{
+		"a/b/":                "a/b/",
+		"a/b//":               "a/b/",
+		"a/b/../":             "a/",
+		"a/b":                 "a/b",
+		"/":                   "/",
+		"a/../":               ".",
+		"$CLEANPATH_TEST_DIR": "/srv/data/",
+	}
+	for input, want := range cases {
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) -k = %q, want %q", input, got, want)
+		}
+		got, _, err = transformPathVerbose(input, opts)
+		if err != nil || got != want {
+			t.Fatalf("transformPathVerbose(%q) -k = %q, %v, want %q", input, got, err, want)
+		}
+	}
+
+	opts = options{keepTrailing: true, sep: "/", absolute: true, baseAbs: "/base"}
+	if got, _ := transformPath("x/", opts); got != "/base/x/" {
+		t.Fatalf("transformPath with -a -k = %q, want %q", got, "/base/x/")
+	}
+}
+
+// TestRunEnvSnapshot verifies a snapshot file replaces the live environment for -e and -E.
+func TestRunEnvSnapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(snapshot, []byte("CLEANPATH_TEST_SNAP=/snap/dir\nOTHER=x\n  continued line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLEANPATH_TEST_SNAP", "/live/dir")
+	t.Setenv("CLEANPATH_TEST_LIVE_ONLY", "/live/only")
+
+	var out, errOut strings.Builder
+	code := run([]string{"-e", "--env-snapshot", snapshot, "$CLEANPATH_TEST_SNAP/a", "$CLEANPATH_TEST_LIVE_ONLY/b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/snap/dir/a\n$CLEANPATH_TEST_LIVE_ONLY/b\n" {
+		t.Fatalf("run -e output = %q, want snapshot values only", out.String())
+	}
+
+	out.Reset()
+	code = run([]string{"-E", "-x", "CLEANPATH_TEST_SNAP", "--env-snapshot", snapshot, "/snap/dir/a", "/live/dir/b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "$CLEANPATH_TEST_SNAP/a\n/live/dir/b\n" {
+		t.Fatalf("run -E = %d, %q, want snapshot-based unexpansion", code, out.String())
+	}
+}
+
+// TestRunJSON verifies --json reports the tilda, clean, and absolute steps as structured data.
+func TestRunJSON(t *testing.T) {
+	// A relative home keeps the path relative after tilda expansion, so -a has work to do.
+	t.Setenv("CLEANPATH_TEST_HOME", "home/me")
+	var out, errOut strings.Builder
+	code := run([]string{"--json", "-t", "--home-sources", "env:CLEANPATH_TEST_HOME", "-a", "-b", "/base", "~/a/../b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d, want 0 (stderr: %q)", code, errOut.String())
+	}
+	if !strings.HasSuffix(out.String(), "}\n") || strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("run output = %q, want one JSON line", out.String())
+	}
+
+	var record jsonRecord
+	if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+		t.Fatalf("output is not JSON: %v", err)
+	}
+	want := jsonRecord{
+		Input:  "~/a/../b",
+		Output: "/base/home/me/b",
+		Steps: []jsonStep{
+			{Name: "initial", From: "~/a/../b"},
+			{Name: "tilda", From: "~/a/../b", To: "home/me/a/../b"},
+			{Name: "clean", From: "home/me/a/../b", To: "home/me/b"},
+			{Name: "absolute", From: "home/me/b", To: "/base/home/me/b"},
+			{Name: "final", From: "/base/home/me/b"},
+		},
+	}
+	if fmt.Sprint(record) != fmt.Sprint(want) {
+		t.Fatalf("record = %+v, want %+v", record, want)
+	}
+}
+
+// TestTransformPreferShorter verifies -A keeps whichever of the relative and absolute forms is shorter.
+func TestTransformPreferShorter(t *testing.T) {
+	cases := map[string]string{
+		"/a/x":             "/a/x",
+		"/a/b/c/d/e/f":     "e/f",
+		"/a/b/c/x/long":    "../x/long",
+		"/a/b/c/d":         ".",
+		"relative/already": "relative/already",
+	}
+	for input, want := range cases {
+		opts := options{unabsolute: true, baseAbs: "/a/b/c/d", unlimitedUp: true, sep: "/", preferShorter: true}
+		got, err := transformPath(input, opts)
+		if err != nil {
+			t.Fatalf("transformPath(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("transformPath(%q) --prefer-shorter = %q, want %q", input, got, want)
+		}
+		got, _, err = transformPathVerbose(input, opts)
+		if err != nil || got != want {
+			t.Fatalf("transformPathVerbose(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+}
+
+// TestRunReplaceExt verifies only a matching extension on the last segment is swapped.
+func TestRunReplaceExt(t *testing.T) {
+	cases := []struct {
+		spec  string
+		input string
+		want  string
+	}{
+		{spec: "md=html", input: "a/b.md", want: "a/b.html"},
+		{spec: ".md=.html", input: "docs.md/readme.md", want: "docs.md/readme.html"},
+		{spec: "md=html", input: "a/b.txt", want: "a/b.txt"},
+		{spec: "md=html", input: "a/bmd", want: "a/bmd"},
+		{spec: "bashrc=x", input: "home/.bashrc", want: "home/.bashrc"},
+		{spec: "tar.gz=tgz", input: "/dist/pkg-1.0.tar.gz", want: "/dist/pkg-1.0.tgz"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"--replace-ext", tc.spec, tc.input}, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q, %q) returned exit code %d (stderr: %q)", tc.spec, tc.input, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q, %q) output = %q, want %q", tc.spec, tc.input, out.String(), tc.want+"\n")
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--replace-ext", "md=html", "dir.md/"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "dir.md\n" {
+		t.Fatalf("run on a directory = %d, %q, want it unchanged", code, out.String())
+	}
+}
+
+// TestRunRealpath verifies -R resolves real symlinks and leaves unresolvable paths unchanged.
+func TestRunRealpath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "real", "inner")
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-R", dir + "/link"}, want: dir + "/real/inner"},
+		{args: []string{"-R", dir + "/./link/"}, want: dir + "/real/inner"},
+		{args: []string{"-R", dir + "/missing/../link/x"}, want: dir + "/link/x"},
+		{args: []string{"-R", "-a", "-b", dir, "link"}, want: dir + "/real/inner"},
+		{args: []string{"-R", "-b", dir, "link"}, want: "real/inner"},
+		{args: []string{"-R", "-A", "-b", dir, dir + "/link"}, want: "real/inner"},
+		{args: []string{"-R", "-b", dir, "nowhere"}, want: "nowhere"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want+"\n")
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"-R", "-w", `C:\a`}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with -R and -w returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunMarkSymlinks verifies --mark-symlinks lists each symlinked component -R resolved,
+// including a link reached through an earlier one.
+func TestRunMarkSymlinks(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"a", "x/c", "y"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "y", "f"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// a/b -> x, and x/c/d -> y, so a/b/c/d/f passes through two links.
+	if err := os.Symlink(filepath.Join(dir, "x"), filepath.Join(dir, "a", "b")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "y"), filepath.Join(dir, "x", "c", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-R", "--mark-symlinks", dir + "/a/b/c/d/f"}, want: dir + "/y/f\tlinks=b,d\n"},
+		{args: []string{"-R", "--mark-symlinks", "-b", dir, "a/b/c/d"}, want: "y\tlinks=b,d\n"},
+		{args: []string{"-R", "--mark-symlinks", "-b", dir, "a/b/c"}, want: "x/c\tlinks=b\n"},
+		{args: []string{"-R", "--mark-symlinks", dir + "/y/f"}, want: dir + "/y/f\tlinks=\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 || out.String() != tc.want {
+			t.Fatalf("run(%q) = %d, %q (stderr %q), want %q", tc.args, code, out.String(), errOut.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--mark-symlinks", dir + "/a/b"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -R returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunDiffExit verifies -d returns exit code 10 only when some path was changed.
+func TestRunDiffExit(t *testing.T) {
+	cases := []struct {
+		args []string
+		want int
+		out  string
+	}{
+		{args: []string{"-d", "a/b"}, want: 0, out: "a/b\n"},
+		{args: []string{"-d", "a/b", "/c"}, want: 0, out: "a/b\n/c\n"},
+		{args: []string{"-d", "a/./b"}, want: exitChanged, out: "a/b\n"},
+		{args: []string{"-d", "a/b", "c//d"}, want: exitChanged, out: "a/b\nc/d\n"},
+		{args: []string{"a/./b"}, want: 0, out: "a/b\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != tc.want {
+			t.Fatalf("run(%q) returned exit code %d, want %d (stderr: %q)", tc.args, code, tc.want, errOut.String())
+		}
+		if out.String() != tc.out {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.out)
+		}
+	}
+}
+
+// TestRunKind verifies --kind labels directories, files, symlinks, and missing paths.
+func TestRunKind(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--kind", "-b", dir, "sub/", "./file", dir + "/link", "sub/../nowhere"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	want := "sub\tdir\nfile\tfile\n" + dir + "/link\tsymlink\nnowhere\tmissing\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+}
+
+// TestRunRewriteFile verifies the longest segment-aligned prefix from --rewrite-file is rewritten.
+func TestRunRewriteFile(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules")
+	rules := "# mount migration\n/mnt/data -> /srv/data\n/mnt/data/archive -> /cold/archive/\n\n/mnt -> /media\nsrc -> lib\n"
+	if err := os.WriteFile(rulesFile, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{input: "/mnt/data/x", want: "/srv/data/x"},
+		{input: "/mnt/data/archive/2020/../2021", want: "/cold/archive/2021"},
+		{input: "/mnt/data/archive", want: "/cold/archive"},
+		{input: "/mnt/./data", want: "/srv/data"},
+		{input: "/mnt/database", want: "/media/database"},
+		{input: "/mntx/data", want: "/mntx/data"},
+		{input: "src/main.go", want: "lib/main.go"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"--rewrite-file", rulesFile, tc.input}, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.input, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.input, out.String(), tc.want+"\n")
+		}
+	}
+
+	badFile := filepath.Join(t.TempDir(), "bad")
+	if err := os.WriteFile(badFile, []byte("/mnt /srv\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out, errOut strings.Builder
+	if code := run([]string{"--rewrite-file", badFile, "/mnt"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with a malformed rule returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunLowercase verifies -l lowercases segments but keeps ~user, $VAR, and Windows roots.
+func TestRunLowercase(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-l", "/Foo/BAR/Baz"}, want: "/foo/bar/baz"},
+		{args: []string{"-l", "/Foo/./BAR/../Baz/"}, want: "/foo/baz"},
+		{args: []string{"-l", "~Alice/Docs"}, want: "~Alice/docs"},
+		{args: []string{"-l", "$HOME/Docs/${XDG_Dir}x/Y"}, want: "$HOME/docs/${XDG_Dir}x/y"},
+		{args: []string{"-l", "-w", `C:\Users\Bob`}, want: `C:\users\bob`},
+		{args: []string{"-l", "-o", "^/foo/(bar)", "-n", "/Top/$1", "/FOO/Bar/Baz"}, want: "/Top/bar/baz"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want+"\n")
+		}
+	}
+}
+
+// TestRunFixedReplace verifies --fixed treats -o metacharacters literally.
+func TestRunFixedReplace(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--fixed", "-o", "v1.*", "-n", "v2", "/opt/v1.*/bin"}, want: "/opt/v2/bin"},
+		{args: []string{"--fixed", "-o", "a.b", "-n", "x", "/a.b/axb/a.b"}, want: "/x/axb/x"},
+		{args: []string{"--fixed", "-o", "a.b", "-n", "$1", "/a.b"}, want: "/$1"},
+		{args: []string{"-o", "a.b", "-n", "x", "/axb"}, want: "/x"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want+"\n")
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--fixed", "-o", "(", "-n", "x", "/a(b"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "/axb\n" {
+		t.Fatalf("run with an invalid regex under --fixed = %d, %q (stderr: %q), want /axb", code, out.String(), errOut.String())
+	}
+	if code := run([]string{"--fixed", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --fixed and no -o returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunDryClean verifies --dry-clean describes the cleanup of dirty inputs and skips clean ones.
+func TestRunDryClean(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--dry-clean", "a//b/./c/..", "/a/b", "//x///y/", "../a/./../b", "/..", `C:\a`}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	want := "a//b/./c/..: would collapse 1 redundant slash, remove 1 '.' segment, resolve 1 '..'\n" +
+		"//x///y/: would collapse 3 redundant slashes, remove the trailing slash\n" +
+		"../a/./../b: would remove 1 '.' segment, resolve 1 '..'\n" +
+		"/..: would resolve 1 '..'\n"
+	if out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if code := run([]string{"--dry-clean", "-w", `C:/a\.\b`}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "C:/a\\.\\b: would remove 1 '.' segment\n" {
+		t.Fatalf("run with -w = %d, %q", code, out.String())
+	}
+}
+
+// TestRunLogStages verifies --log-stages writes only the listed steps.
+func TestRunLogStages(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_DIR", "/data")
+	var out, errOut strings.Builder
+	args := []string{"--log-tsv", "--log-stages", "env,regex", "-e", "-o", "data", "-n", "srv", "$CLEANPATH_TEST_DIR/./x"}
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/srv/x\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/srv/x\n")
+	}
+	want := "env\t$CLEANPATH_TEST_DIR/./x\t/data/./x\nregex\t/data/x\t/srv/x\n"
+	if errOut.String() != want {
+		t.Fatalf("log = %q, want %q", errOut.String(), want)
+	}
+
+	errOut.Reset()
+	if code := run([]string{"--log-tsv", "--log-stages", "initial, final", "a/./b"}, strings.NewReader(""), &out, &errOut); code != 0 {
+		t.Fatalf("run with initial,final returned exit code %d", code)
+	}
+	if errOut.String() != "initial\ta/./b\t\nfinal\ta/b\t\n" {
+		t.Fatalf("log = %q, want only the initial and final lines", errOut.String())
+	}
+
+	if code := run([]string{"-v", "--log-stages", "env,bogus", "a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with an unknown stage returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunReplacementPairs verifies repeated -o/-n pairs apply in order and counts must match.
+func TestRunReplacementPairs(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--log-tsv", "--log-stages", "regex", "-o", "a", "-n", "b", "-o", "b", "-n", "c", "/a/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/c/x\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/c/x\n")
+	}
+	if errOut.String() != "regex\t/a/x\t/b/x\nregex\t/b/x\t/c/x\n" {
+		t.Fatalf("log = %q, want one regex step per pair", errOut.String())
+	}
+
+	out.Reset()
+	if code := run([]string{"-o", "b", "-n", "c", "-o", "a", "-n", "b", "/a/x"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "/b/x\n" {
+		t.Fatalf("run with reversed pairs = %d, %q, want /b/x", code, out.String())
+	}
+	if code := run([]string{"-o", "a", "-n", "b", "-o", "c", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with mismatched -o/-n counts returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunUnique verifies -q prints each normalized path once in first-seen order.
+func TestRunUnique(t *testing.T) {
+	var out, errOut strings.Builder
+	stdin := strings.NewReader("/a/b\n/a/./b\n/a//b/\n/c\n/a/x/../b\n")
+	code := run([]string{"-q", "-i", "/c/."}, stdin, &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/c\n/a/b\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/c\n/a/b\n")
+	}
+
+	out.Reset()
+	if code := run([]string{"/a/b", "/a/./b"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "/a/b\n/a/b\n" {
+		t.Fatalf("run without -q = %d, %q, want duplicates kept", code, out.String())
+	}
+}
+
+// TestRunWindowsHome verifies -w takes ~ from %USERPROFILE%, then %HOMEDRIVE%%HOMEPATH%,
+// places ~name next to it, and collapses the profile with -T and --home-to-env regardless
+// of case and separator.
+func TestRunWindowsHome(t *testing.T) {
+	t.Setenv("HOME", "/home/unix")
+	t.Setenv("USERPROFILE", `C:\Users\me`)
+	t.Setenv("HOMEDRIVE", "D:")
+	t.Setenv("HOMEPATH", `\Profiles\me`)
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-w", "-t", `~\docs`}, want: `C:\Users\me\docs`},
+		{args: []string{"-w", "-t", "~/docs/../x"}, want: `C:\Users\me\x`},
+		{args: []string{"-w", "-t", `~bob\docs`}, want: `C:\Users\bob\docs`},
+		{args: []string{"-w", "-t", "-u", "bob", `~\docs`}, want: `C:\Users\bob\docs`},
+		{args: []string{"-w", "-t", "--home-sources", "env:HOME", `~\docs`}, want: `\home\unix\docs`},
+		{args: []string{"-w", "-T", `C:\Users\me\docs`}, want: `~\docs`},
+		{args: []string{"-w", "-T", `c:/users/ME/docs`}, want: `~\docs`},
+		{args: []string{"-w", "-T", `C:\Users\meow`}, want: `C:\Users\meow`},
+		{args: []string{"-w", "--home-to-env", `C:\Users\me\docs`}, want: `$HOME\docs`},
+		{args: []string{"-w", "--home-to-env", `c:\users\me`}, want: `$HOME`},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want+"\n")
+		}
+	}
+
+	t.Setenv("USERPROFILE", "")
+	var out, errOut strings.Builder
+	if code := run([]string{"-w", "-t", `~\docs`}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "D:\\Profiles\\me\\docs\n" {
+		t.Fatalf("run with HOMEDRIVE/HOMEPATH = %d, %q, want D:\\Profiles\\me\\docs", code, out.String())
+	}
+}
+
+// TestRunCacheKey verifies --cache-key gives equivalent inputs the same key and different inputs different keys.
+func TestRunCacheKey(t *testing.T) {
+	key := func(args ...string) string {
+		t.Helper()
+		var out, errOut strings.Builder
+		code := run(append([]string{"--cache-key", "-b", "/base"}, args...), strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", args, code, errOut.String())
+		}
+		return strings.TrimSuffix(out.String(), "\n")
+	}
+
+	if got := key(`x\y\..\z/`); got != "/base/x/z" {
+		t.Fatalf("cache key = %q, want %q", got, "/base/x/z")
+	}
+	if a, b := key("x/./z"), key("/base//x/z/"); a != b {
+		t.Fatalf("equivalent inputs gave keys %q and %q", a, b)
+	}
+	if a, b := key("--target-os", "linux", "/A/b"), key("--target-os", "linux", "/a/b"); a == b {
+		t.Fatalf("case-different inputs share key %q without case folding", a)
+	}
+	if fold := runtime.GOOS == "windows" || runtime.GOOS == "darwin"; (key("/A/b") == key("/a/b")) != fold {
+		t.Fatalf("keys without --target-os folded case = %v, want %v on %s", !fold, fold, runtime.GOOS)
+	}
+	if a, b := key("--target-os", "darwin", "/A/b"), key("--target-os", "windows", `\a\B`); a != b || a != "/a/b" {
+		t.Fatalf("case-folded keys = %q and %q, want both /a/b", a, b)
+	}
+	if a, b := key("/a/b"), key("/a/c"); a == b {
+		t.Fatalf("different inputs share key %q", a)
+	}
+	if a, b := key("/caf\u00e9"), key("/cafe\u0301"); a != b || a != "/caf\u00e9" {
+		t.Fatalf("composed and decomposed keys = %q and %q, want both %q", a, b, "/caf\u00e9")
+	}
+	if a, b := key("--target-os", "darwin", "/CAF\u00c9"), key("--target-os", "darwin", "/cafe\u0301"); a != b {
+		t.Fatalf("case-folded composed and decomposed keys = %q and %q", a, b)
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--cache-key", "-A", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --cache-key and -A returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunFromFile verifies -f reads paths from a file before the arguments.
+func TestRunFromFile(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "paths")
+	if err := os.WriteFile(list, []byte("/a/./b\nc//d\n/e/f/..\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"-f", list, "/x/./y"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/a/b\nc/d\n/e\n/x/y\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/a/b\nc/d\n/e\n/x/y\n")
+	}
+
+	nulList := filepath.Join(dir, "nul")
+	if err := os.WriteFile(nulList, []byte("/a/./b\x00new\nline\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if code := run([]string{"-0", "--from-file", nulList}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "/a/b\x00new\nline\x00" {
+		t.Fatalf("run with -0 -f = %d, %q", code, out.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	if code := run([]string{"-f", filepath.Join(dir, "missing"), "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with a missing -f file returned exit code %d, want 1", code)
+	}
+	if !strings.Contains(errOut.String(), "missing") || out.String() != "" {
+		t.Fatalf("missing -f file: stdout %q, stderr %q", out.String(), errOut.String())
+	}
+}
+
+// TestRunStats verifies --stats writes totals and per-step counts to stderr only.
+func TestRunStats(t *testing.T) {
+	var out, errOut strings.Builder
+	args := []string{"--stats", "-A", "--relative-strict", "-b", "/base", "/base/./x", "/other", "y", "/base/z/../w"}
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run returned exit code %d, want 1 (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "x\ny\nw\n" {
+		t.Fatalf("run output = %q", out.String())
+	}
+	want := "cleanpath: /other: cannot relativize against /base within -p 0\n" +
+		"cleanpath: stats: 4 paths, 2 changed, 1 failed\n" +
+		"cleanpath: stats: clean 2\n" +
+		"cleanpath: stats: unabsolute 2\n"
+	if errOut.String() != want {
+		t.Fatalf("stderr = %q, want %q", errOut.String(), want)
+	}
+}
+
+// TestRunReportSavings verifies --report-savings sums the bytes trimmed from changed paths.
+func TestRunReportSavings(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--report-savings", "/a/./b", "/c", "x//y/", "/d/e/../f"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/a/b\n/c\nx/y\n/d/f\n" {
+		t.Fatalf("run output = %q", out.String())
+	}
+	// 6-4 + 5-3 + 9-4 = 9 bytes across three changed paths.
+	if errOut.String() != "cleanpath: savings: 9 bytes across 3 changed paths\n" {
+		t.Fatalf("stderr = %q", errOut.String())
+	}
+
+	errOut.Reset()
+	if code := run([]string{"--report-savings", "--prepend", "/root", "/a/b"}, strings.NewReader(""), &out, &errOut); code != 0 {
+		t.Fatalf("run returned exit code %d", code)
+	}
+	if errOut.String() != "cleanpath: savings: -5 bytes across 1 changed paths\n" {
+		t.Fatalf("stderr with a growing path = %q", errOut.String())
+	}
+}
+
+// TestRunInteractive verifies --interactive emits only confirmed changes and auto-yes accepts all.
+func TestRunInteractive(t *testing.T) {
+	restore := openTerminal
+	defer func() { openTerminal = restore }()
+	openTerminal = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("y\nno\nYes\n")), nil
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--interactive", "/a/./b", "/keep", "c//d", "e/../f", "/g/"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "/a/b\n/keep\nf\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "/a/b\n/keep\nf\n")
+	}
+	wantPrompts := "cleanpath: /a/./b -> /a/b? [y/N] cleanpath: c//d -> c/d? [y/N] " +
+		"cleanpath: e/../f -> f? [y/N] cleanpath: /g/ -> /g? [y/N] "
+	if errOut.String() != wantPrompts {
+		t.Fatalf("prompts = %q, want %q", errOut.String(), wantPrompts)
+	}
+
+	out.Reset()
+	errOut.Reset()
+	if code := run([]string{"--interactive=auto-yes", "/a/./b", "/keep"}, strings.NewReader(""), &out, &errOut); code != 0 {
+		t.Fatalf("run with auto-yes returned exit code %d", code)
+	}
+	if out.String() != "/a/b\n/keep\n" || errOut.String() != "cleanpath: /a/./b -> /a/b (auto-yes)\n" {
+		t.Fatalf("auto-yes: stdout %q, stderr %q", out.String(), errOut.String())
+	}
+
+	openTerminal = func() (io.ReadCloser, error) { return nil, errors.New("no tty") }
+	if code := run([]string{"--interactive", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without a terminal returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunOrder verifies -O reorders the pipeline steps and rejects bad lists.
+func TestRunOrder(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-o", "^a/\\.\\./", "-n", "x/", "a/../b"}, want: "b"},
+		{args: []string{"-O", "regex,clean", "-o", "^a/\\.\\./", "-n", "x/", "a/../b"}, want: "x/b"},
+		{args: []string{"--order", "clean,regex", "-o", "^a/\\.\\./", "-n", "x/", "a/../b"}, want: "b"},
+		{args: []string{"-o", "^/base", "-n", "/srv", "-a", "-b", "/base", "x"}, want: "/srv/x"},
+		{args: []string{"-O", "regex,absolute", "-o", "^/base", "-n", "/srv", "-a", "-b", "/base", "x"}, want: "/base/x"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want+"\n")
+		}
+	}
+
+	order, err := resolveOrder("absolute, env")
+	if err != nil || strings.Join(order, ",") != "tilda,absolute,env,clean,regex" {
+		t.Fatalf("resolveOrder(absolute, env) = %q, %v", order, err)
+	}
+	for _, raw := range []string{"clean,clean", "tilde", "env,"} {
+		if _, err := resolveOrder(raw); err == nil {
+			t.Fatalf("resolveOrder(%q) returned no error", raw)
+		}
+	}
+}
+
+// TestRunDevicePrefix verifies --device-prefix cleans only the path after scheme: and user@host: prefixes.
+func TestRunDevicePrefix(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{input: "tmpfs:/run/./foo", want: "tmpfs:/run/foo"},
+		{input: "sshfs:user@host:/remote/../path//x/", want: "sshfs:user@host:/path/x"},
+		{input: "user@host:dir/./a", want: "user@host:dir/a"},
+		{input: "/a/b:c/../d", want: "/a/d"},
+		{input: "host:", want: "host:"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"--device-prefix", tc.input}, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.input, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.input, out.String(), tc.want+"\n")
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"tmpfs:/run/./foo"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "tmpfs:/run/foo\n" {
+		t.Fatalf("run without --device-prefix = %d, %q", code, out.String())
+	}
+	out.Reset()
+	if code := run([]string{"tmpfs:/../foo"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "foo\n" {
+		t.Fatalf("run without --device-prefix = %d, %q, want the prefix treated as a segment", code, out.String())
+	}
+}
+
+// TestRunAllUsers verifies --all-users collapses any passwd home to ~name, preferring the longest match.
+func TestRunAllUsers(t *testing.T) {
+	dir := t.TempDir()
+	passwd := filepath.Join(dir, "passwd")
+	content := strings.Join([]string{
+		"root:x:0:0:root:/root:/bin/sh",
+		"daemon:x:1:1:daemon:/:/usr/sbin/nologin",
+		"alice:x:1000:1000::/home/alice:/bin/sh",
+		"bob:x:1001:1001::/home/alice/shared/bob/:/bin/sh",
+		"me:x:1002:1002::/home/me:/bin/sh",
+		"",
+	}, "\n")
+	if err := os.WriteFile(passwd, []byte(content), 0o644); err != nil {
+		t.Fatalf("write passwd: %v", err)
+	}
+	restore := passwdFile
+	defer func() { passwdFile = restore }()
+	passwdFile = passwd
+	t.Setenv("HOME", "/home/me")
+
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{input: "/home/alice/x", want: "~alice/x"},
+		{input: "/home/alice/shared/bob/y", want: "~bob/y"},
+		{input: "/home/alicex", want: "/home/alicex"},
+		{input: "/home/me/z", want: "~/z"},
+		{input: "/root", want: "~root"},
+		{input: "/usr/bin", want: "/usr/bin"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"-T", "--all-users", "--home-sources", "env:HOME", tc.input}, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.input, code, errOut.String())
+		}
+		if out.String() != tc.want+"\n" {
+			t.Fatalf("run(%q) output = %q, want %q", tc.input, out.String(), tc.want+"\n")
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--all-users", "/home/alice"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -T returned exit code %d, want 1", code)
+	}
+	passwdFile = filepath.Join(dir, "missing")
+	if code := run([]string{"-T", "--all-users", "/home/alice"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with a missing user database returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunEnvDefaults verifies -e applies ${VAR:-WORD} for an unset variable, whether it
+// is named with -x, allowed by -x -, or allowed by a bare -e.
+func TestRunEnvDefaults(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_UNSET", "")
+	os.Unsetenv("CLEANPATH_TEST_UNSET")
+	for _, args := range [][]string{
+		{"-e", "-x", "CLEANPATH_TEST_UNSET", "${CLEANPATH_TEST_UNSET:-/opt/./app}/bin"},
+		{"-e", "${CLEANPATH_TEST_UNSET:-/opt/./app}/bin"},
+		{"-e", "-x", "-", "${CLEANPATH_TEST_UNSET:-/opt/./app}/bin"},
+	} {
+		var out, errOut strings.Builder
+		code := run(args, strings.NewReader(""), &out, &errOut)
+		if code != 0 || out.String() != "/opt/app/bin\n" {
+			t.Fatalf("run(%q) = %d, %q, want %q", args, code, out.String(), "/opt/app/bin\n")
+		}
+	}
+}
+
+// TestRunByteBudget verifies --byte-budget prefers the relative form, falls back to the absolute one, and fails when neither fits.
+func TestRunByteBudget(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+		code  int
+	}{
+		{input: "/a/b/c/d", want: "c/d\n"},
+		{input: "/srv/x", want: "/srv/x\n"},
+		{input: "/a/srv/longer/name", code: 1},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"-A", "-b", "/a/b", "-p", "-", "--byte-budget", "8", tc.input}, strings.NewReader(""), &out, &errOut)
+		if code != tc.code || out.String() != tc.want {
+			t.Fatalf("run(%q) = %d, %q, want %d, %q (stderr: %q)", tc.input, code, out.String(), tc.code, tc.want, errOut.String())
+		}
+		if tc.code != 0 && !strings.Contains(errOut.String(), "fits --byte-budget 8") {
+			t.Fatalf("run(%q) stderr = %q, want a --byte-budget error", tc.input, errOut.String())
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--byte-budget", "8", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -A returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunParallelFiles verifies --parallel-files transforms each -f file concurrently and writes
+// source-tagged output grouped in file order.
+func TestRunParallelFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	var firstLines, secondLines, want strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&firstLines, "/a/./%d//x\n", i)
+		fmt.Fprintf(&secondLines, "/b/%d/../y\n", i)
+	}
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&want, "%s\t/a/%d/x\n", first, i)
+	}
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&want, "%s\t/b/y\n", second)
+	}
+	want.WriteString("/c\n")
+	if err := os.WriteFile(first, []byte(firstLines.String()), 0o644); err != nil {
+		t.Fatalf("write first: %v", err)
+	}
+	if err := os.WriteFile(second, []byte(secondLines.String()), 0o644); err != nil {
+		t.Fatalf("write second: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"--parallel-files", "-f", first, "-f", second, "/c/."}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != want.String() {
+		t.Fatalf("run output = %q, want %q", out.String(), want.String())
+	}
+
+	out.Reset()
+	code = run([]string{"-f", first, "-f", second}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || strings.Count(out.String(), "\n") != 400 || strings.Contains(out.String(), "\t") {
+		t.Fatalf("run with repeated -f = %d, %d lines, want 400 untagged lines", code, strings.Count(out.String(), "\n"))
+	}
+
+	if code := run([]string{"--parallel-files", "-f", first, "-f", filepath.Join(dir, "missing")}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with a missing file returned exit code %d, want 1", code)
+	}
+	if code := run([]string{"--parallel-files", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -f returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunStrictEnv verifies --strict-env fails paths with unallowed or unset variables and names them.
+func TestRunStrictEnv(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_SET", "/srv")
+	t.Setenv("CLEANPATH_TEST_UNSET", "")
+	os.Unsetenv("CLEANPATH_TEST_UNSET")
+
+	var out, errOut strings.Builder
+	code := run([]string{"-e", "$CLEANPATH_TEST_UNSET/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "$CLEANPATH_TEST_UNSET/x\n" {
+		t.Fatalf("run without --strict-env = %d, %q, want the reference left literal", code, out.String())
+	}
+
+	out.Reset()
+	code = run([]string{"-e", "--strict-env", "$CLEANPATH_TEST_UNSET/x", "$CLEANPATH_TEST_SET/./y"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 {
+		t.Fatalf("run with --strict-env returned exit code %d, want 1", code)
+	}
+	if out.String() != "/srv/y\n" {
+		t.Fatalf("run with --strict-env output = %q, want only the defined path", out.String())
+	}
+	if !strings.Contains(errOut.String(), "$CLEANPATH_TEST_UNSET/x: undefined variable $CLEANPATH_TEST_UNSET (--strict-env)") {
+		t.Fatalf("run with --strict-env stderr = %q, want the variable named", errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"-e", "--strict-env", "-x", "CLEANPATH_TEST_SET", "${HOME}/$CLEANPATH_TEST_UNSET"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "undefined variables $HOME, $CLEANPATH_TEST_UNSET") {
+		t.Fatalf("run with disallowed variables = %d, stderr %q", code, errOut.String())
+	}
+
+	out.Reset()
+	code = run([]string{"-e", "--strict-env", "-x", "CLEANPATH_TEST_UNSET", "${CLEANPATH_TEST_UNSET:-/opt}/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "/opt/x\n" {
+		t.Fatalf("run with a :- default = %d, %q, want %q", code, out.String(), "/opt/x\n")
+	}
+
+	if code := run([]string{"--strict-env", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -e returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunPrintBase verifies --print-base writes a relative base resolved against the cwd to stderr once.
+func TestRunPrintBase(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	code := run([]string{"--print-base", "-b", "proj/./src", "a/../b", "c"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if want := "cleanpath: base: " + dir + "/proj/src\n"; errOut.String() != want {
+		t.Fatalf("run stderr = %q, want %q", errOut.String(), want)
+	}
+	if out.String() != "b\nc\n" {
+		t.Fatalf("run output = %q, want the paths unchanged by --print-base", out.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"--print-base", "--relative-to-all", "-b", "x", "-b", "/y", "/y/z"}, strings.NewReader(""), &out, &errOut)
+	if want := "cleanpath: base: " + dir + "/x\ncleanpath: base: /y\n"; code != 0 || errOut.String() != want {
+		t.Fatalf("run with --relative-to-all = %d, stderr %q, want %q", code, errOut.String(), want)
+	}
+}
+
+// TestRunCommonSuffix verifies --common-suffix writes the trailing segments shared by all results.
+func TestRunCommonSuffix(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"/srv/a/config/app.yaml", "/srv/b/./config//app.yaml", "other/config/app.yaml"}, want: "config/app.yaml\n"},
+		{args: []string{"/srv/a/config/app.yaml", "/srv/a/config/db.yaml"}, want: "\n"},
+		{args: []string{"x/app.yaml", "y/myapp.yaml"}, want: "\n"},
+		{args: []string{"/srv/./app.yaml"}, want: "srv/app.yaml\n"},
+		{args: []string{"/a/b/c", "/a/b/c"}, want: "a/b/c\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(append([]string{"--common-suffix"}, tc.args...), strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--common-suffix", "--ancestors", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --ancestors returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunDotfiles verifies each --dotfiles policy treats .config as a segment and . as navigation.
+func TestRunDotfiles(t *testing.T) {
+	cases := []struct {
+		policy string
+		input  string
+		want   string
+		stderr string
+	}{
+		{policy: "keep", input: "/home/me/./.config/app", want: "/home/me/.config/app\n"},
+		{policy: "keep", input: "./a/.", want: "a\n"},
+		{policy: "strip", input: "/home/me/./.config/app", want: "/home/me/app\n"},
+		{policy: "strip", input: "./a/.", want: "a\n"},
+		{policy: "strip", input: ".config/.cache", want: ".\n"},
+		{policy: "strip", input: "/.config", want: "/\n"},
+		{policy: "strip", input: "a/..", want: ".\n"},
+		{policy: "flag", input: "/home/me/./.config/.cache/app", want: "/home/me/.config/.cache/app\n", stderr: "cleanpath: /home/me/./.config/.cache/app: dotfile components .config, .cache\n"},
+		{policy: "flag", input: "./a/.", want: "a\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run([]string{"--dotfiles=" + tc.policy, tc.input}, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%s, %q) returned exit code %d (stderr: %q)", tc.policy, tc.input, code, errOut.String())
+		}
+		if out.String() != tc.want || errOut.String() != tc.stderr {
+			t.Fatalf("run(%s, %q) = %q, stderr %q, want %q, stderr %q", tc.policy, tc.input, out.String(), errOut.String(), tc.want, tc.stderr)
+		}
+	}
+
+	if got := stripDotfiles(`C:\.config\app`, `\`, true); got != `C:\app` {
+		t.Fatalf("stripDotfiles drive = %q, want %q", got, `C:\app`)
+	}
+	if got := stripDotfiles(`\\server\share\.git\x`, `\`, true); got != `\\server\share\x` {
+		t.Fatalf("stripDotfiles UNC = %q, want %q", got, `\\server\share\x`)
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--dotfiles", "hide", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with an invalid policy returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunStrictParent verifies --strict-parent turns the silent -p passthrough into an error.
+func TestRunStrictParent(t *testing.T) {
+	args := []string{"-A", "-b", "/a/b/c", "-p", "1", "/x/y"}
+
+	var out, errOut strings.Builder
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "/x/y\n" || errOut.String() != "" {
+		t.Fatalf("run without --strict-parent = %d, %q, stderr %q, want the absolute path passed through", code, out.String(), errOut.String())
+	}
+
+	out.Reset()
+	code = run(append([]string{"--strict-parent"}, args...), strings.NewReader(""), &out, &errOut)
+	if code != 1 || out.String() != "" {
+		t.Fatalf("run with --strict-parent = %d, %q, want exit code 1 and no output", code, out.String())
+	}
+	if want := "cleanpath: /x/y: cannot relativize against /a/b/c within -p 1\n"; errOut.String() != want {
+		t.Fatalf("run with --strict-parent stderr = %q, want %q", errOut.String(), want)
+	}
+}
+
+// TestRunBaseEnv verifies --base-env takes the base from a variable, and rejects unset variables and -b.
+func TestRunBaseEnv(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_ROOT", "/srv/./project/")
+	t.Setenv("CLEANPATH_TEST_UNSET", "")
+	os.Unsetenv("CLEANPATH_TEST_UNSET")
+
+	var out, errOut strings.Builder
+	code := run([]string{"--base-env", "CLEANPATH_TEST_ROOT", "--print-base", "-A", "/srv/project/src/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if errOut.String() != "cleanpath: base: /srv/project\n" || out.String() != "src/x\n" {
+		t.Fatalf("run = %q, stderr %q, want %q with base /srv/project", out.String(), errOut.String(), "src/x\n")
+	}
+
+	out.Reset()
+	errOut.Reset()
+	if code := run([]string{"--base-env", "CLEANPATH_TEST_UNSET", "-a", "x"}, strings.NewReader(""), &out, &errOut); code != 1 || !strings.Contains(errOut.String(), "$CLEANPATH_TEST_UNSET is not set") {
+		t.Fatalf("run with an unset variable = %d, stderr %q", code, errOut.String())
+	}
+	errOut.Reset()
+	if code := run([]string{"--base-env", "CLEANPATH_TEST_ROOT", "-b", "/a", "-a", "x"}, strings.NewReader(""), &out, &errOut); code != 1 || !strings.Contains(errOut.String(), "cannot use --base-env with -b") {
+		t.Fatalf("run with -b = %d, stderr %q", code, errOut.String())
+	}
+}
+
+// TestRunGetentFallback verifies ~name falls back to a cached getent passwd lookup unless --no-getent is set.
+func TestRunGetentFallback(t *testing.T) {
+	restore := getentPasswd
+	defer func() { getentPasswd = restore }()
+	calls := 0
+	getentPasswd = func(name string) (string, error) {
+		calls++
+		if name != "cleanpath-ldap-user" {
+			return "", errors.New("exit status 2")
+		}
+		return "cleanpath-ldap-user:*:5000:5000:LDAP user:/net/home/ldap:/bin/bash\n", nil
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"-t", "~cleanpath-ldap-user/./x", "~cleanpath-ldap-user/y", "~cleanpath-no-such-user/z"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if want := "/net/home/ldap/x\n/net/home/ldap/y\n~cleanpath-no-such-user/z\n"; out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+	if calls != 2 {
+		t.Fatalf("getent ran %d times, want 2 (one per unknown name)", calls)
+	}
+
+	out.Reset()
+	code = run([]string{"-t", "--no-getent", "~cleanpath-ldap-user/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "~cleanpath-ldap-user/x\n" {
+		t.Fatalf("run with --no-getent = %d, %q, want the tilda left literal", code, out.String())
+	}
+	if calls != 2 {
+		t.Fatalf("getent ran with --no-getent")
+	}
+}
+
+// TestRunMaxDistinct verifies --max-distinct fails, or with passthrough stops deduplicating, past N outputs.
+func TestRunMaxDistinct(t *testing.T) {
+	args := []string{"-q", "--max-distinct", "2", "/a", "/a/.", "/b", "/c", "/a", "/c"}
+
+	var out, errOut strings.Builder
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 1 || out.String() != "/a\n/b\n" {
+		t.Fatalf("run = %d, %q, want exit code 1 after %q", code, out.String(), "/a\n/b\n")
+	}
+	if errOut.String() != "cleanpath: more than 2 distinct outputs (--max-distinct)\n" {
+		t.Fatalf("run stderr = %q", errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	code = run(append([]string{"--on-max-distinct", "passthrough"}, args...), strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "/a\n/b\n/c\n/a\n/c\n" {
+		t.Fatalf("run with passthrough = %d, %q, want %q", code, out.String(), "/a\n/b\n/c\n/a\n/c\n")
+	}
+	if !strings.Contains(errOut.String(), "no longer removing duplicates") {
+		t.Fatalf("run with passthrough stderr = %q, want a warning", errOut.String())
+	}
+
+	out.Reset()
+	if code := run([]string{"-q", "--max-distinct", "3", "/a", "/a", "/b", "/c"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != "/a\n/b\n/c\n" {
+		t.Fatalf("run within the cap = %d, %q", code, out.String())
+	}
+	if code := run([]string{"--max-distinct", "3", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -q returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunDotSlash verifies --dot-slash renders the base as ./ and children with a leading ./ under -A.
+func TestRunDotSlash(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"/a/b"}, want: "./\n"},
+		{args: []string{"/a/b/."}, want: "./\n"},
+		{args: []string{"-k", "/a/b/"}, want: "./\n"},
+		{args: []string{"/a/b/another-dir/xxx"}, want: "./another-dir/xxx\n"},
+		{args: []string{"-k", "/a/b/another-dir/"}, want: "./another-dir/\n"},
+		{args: []string{"-p", "1", "/a/x"}, want: "../x\n"},
+		{args: []string{"/srv/x"}, want: "/srv/x\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		args := append([]string{"-A", "-b", "/a/b", "--dot-slash"}, tc.args...)
+		code := run(args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", args, out.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"-A", "-b", "/a/b", "/a/b"}, strings.NewReader(""), &out, &errOut); code != 0 || out.String() != ".\n" {
+		t.Fatalf("run without --dot-slash = %d, %q, want %q", code, out.String(), ".\n")
+	}
+	if code := run([]string{"--dot-slash", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -A returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunWinEnv verifies --win-env expands and emits %VAR% under the same allow-list as $VAR.
+func TestRunWinEnv(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("CLEANPATH_TEST_OTHER", "/other")
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-e", "-x", "HOME", "--win-env", `%HOME%\docs`}, want: `/home/me\docs` + "\n"},
+		{args: []string{"-e", "-x", "HOME", "--win-env", "-w", `%HOME%\docs\.\x`}, want: `\home\me\docs\x` + "\n"},
+		{args: []string{"-e", "-x", "HOME", "--win-env", "%CLEANPATH_TEST_OTHER%/x"}, want: "%CLEANPATH_TEST_OTHER%/x\n"},
+		{args: []string{"-e", "-x", "HOME", "--win-env", "$HOME/%HOME/50%"}, want: "/home/me/%HOME/50%\n"},
+		{args: []string{"-e", "-x", "HOME", "%HOME%/docs"}, want: "%HOME%/docs\n"},
+		{args: []string{"-E", "-x", "HOME", "--win-env", "/home/me/docs"}, want: "%HOME%/docs\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	code := run([]string{"-e", "-x", "HOME", "--win-env", "--strict-env", "%CLEANPATH_TEST_OTHER%/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "undefined variable $CLEANPATH_TEST_OTHER") {
+		t.Fatalf("run with --strict-env = %d, stderr %q", code, errOut.String())
+	}
+	if code := run([]string{"--win-env", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -e or -E returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunCleanAfterEnv verifies --clean-after-env resolves . segments from a value even when clean runs first.
+func TestRunCleanAfterEnv(t *testing.T) {
+	t.Setenv("CWD", ".")
+	t.Setenv("UP", "a/..")
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-e", "-x", "CWD", "$CWD/foo"}, want: "foo\n"},
+		{args: []string{"-e", "-x", "CWD", "-O", "clean,env", "$CWD/foo"}, want: "./foo\n"},
+		{args: []string{"-e", "-x", "CWD", "-O", "clean,env", "--clean-after-env", "$CWD/foo"}, want: "foo\n"},
+		{args: []string{"-e", "-x", "CWD", "-O", "clean,env", "--clean-after-env", "$CWD"}, want: ".\n"},
+		{args: []string{"-e", "-x", "UP", "-O", "clean,env", "--clean-after-env", "-k", "$UP/b/"}, want: "b/\n"},
+		{args: []string{"-e", "-x", "CWD", "-O", "clean,env", "--clean-after-env", "./x/$OTHER"}, want: "x/$OTHER\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--clean-after-env", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -e returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunAnnotate verifies --annotate writes input and output columns with a configurable separator.
+func TestRunAnnotate(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--annotate", "/a/./b//c/", "/a/b"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if want := "/a/./b//c/\t/a/b/c\n/a/b\t/a/b\n"; out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	code = run([]string{"--annotate", "--annotate-sep", " -> ", "--last-stage", "x/../y"}, strings.NewReader(""), &out, &errOut)
+	if want := "x/../y -> y\tclean\n"; code != 0 || out.String() != want {
+		t.Fatalf("run with --annotate-sep = %d, %q, want %q", code, out.String(), want)
+	}
+
+	if code := run([]string{"--annotate-sep", ":", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --annotate-sep alone returned exit code %d, want 1", code)
+	}
+	if code := run([]string{"--annotate", "--json", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --json returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunWarnAmbiguous verifies --warn-ambiguous logs paths that two bases relativize at equal cost.
+func TestRunWarnAmbiguous(t *testing.T) {
+	var out, errOut strings.Builder
+	args := []string{"-A", "-v", "--warn-ambiguous", "--log-stages", "final", "-p", "1", "-b", "/a/x", "-b", "/a/y", "/a/z/f", "/a/y/g"}
+	code := run(args, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if out.String() != "../z/f\ng\n" {
+		t.Fatalf("run output = %q, want %q", out.String(), "../z/f\ng\n")
+	}
+	want := "cleanpath: /a/z/f: ambiguous bases /a/x, /a/y tie at 3 segments, using /a/y (last -b wins)\n"
+	var got strings.Builder
+	for _, line := range strings.SplitAfter(errOut.String(), "\n") {
+		if strings.Contains(line, "ambiguous") {
+			got.WriteString(line)
+		}
+	}
+	if got.String() != want {
+		t.Fatalf("run ambiguity log = %q, want %q", got.String(), want)
+	}
+
+	errOut.Reset()
+	out.Reset()
+	code = run([]string{"-A", "-v", "--warn-ambiguous", "--log-tsv", "-p", "1", "-b", "/a/x", "-b", "/a/y", "/a/z/f"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || !strings.Contains(errOut.String(), "ambiguous\t/a/z/f\t/a/x,/a/y\n") {
+		t.Fatalf("run with --log-tsv = %d, stderr %q", code, errOut.String())
+	}
+
+	if code := run([]string{"-A", "--warn-ambiguous", "-b", "/a", "/a/b"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run without -v returned exit code %d, want 1", code)
+	}
+
+	errOut.Reset()
+	out.Reset()
+	code = run([]string{"-A", "-v", "--warn-ambiguous", "--relative-to-all", "--log-stages", "final", "-b", "/a", "-b", "/a/x", "/a/x/f"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "x/f\tf\n" {
+		t.Fatalf("run with --relative-to-all = %d, %q, want one column per -b %q", code, out.String(), "x/f\tf\n")
+	}
+
+	// The last -b is not among the tied bases, so the tie never affected the output.
+	errOut.Reset()
+	out.Reset()
+	code = run([]string{"-A", "-v", "--warn-ambiguous", "-p", "1", "-b", "/t/a", "-b", "/t/b", "-b", "/usr/lib", "/t/x"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "/t/x\n" || strings.Contains(errOut.String(), "ambiguous") {
+		t.Fatalf("run with the chosen base outside the tie = %d, %q, stderr %q, want no warning", code, out.String(), errOut.String())
+	}
+
+	// --prefer-shorter keeps /z, so -A logs no step, but /x and /y still tie.
+	errOut.Reset()
+	out.Reset()
+	code = run([]string{"-A", "-v", "--warn-ambiguous", "--prefer-shorter", "-p", "1", "-b", "/x", "-b", "/y", "/z"}, strings.NewReader(""), &out, &errOut)
+	want = "cleanpath: /z: ambiguous bases /x, /y tie at 2 segments, using /y (last -b wins)\n"
+	if code != 0 || out.String() != "/z\n" || !strings.Contains(errOut.String(), want) {
+		t.Fatalf("run with an unchanged path = %d, %q, stderr %q, want %q", code, out.String(), errOut.String(), want)
+	}
+}
+
+// TestRunPercentEncode verifies --percent-encode escapes each segment while keeping the separators.
+func TestRunPercentEncode(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"/srv/./my docs/a?b#c"}, want: "/srv/my%20docs/a%3Fb%23c\n"},
+		{args: []string{"rel/100%/x y"}, want: "rel/100%25/x%20y\n"},
+		{args: []string{"/plain/path"}, want: "/plain/path\n"},
+		{args: []string{"--decode-percent", "/a%20b/../c%20d"}, want: "/c%20d\n"},
+		{args: []string{"--prepend", "https://host", "/a b"}, want: "https://host/a%20b\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		args := append([]string{"--percent-encode"}, tc.args...)
+		code := run(args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", args, out.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--percent-encode", "--target-os", "windows", "/a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --target-os windows returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunOutputSep verifies --output-sep joins results on one line and conflicts with -0.
+func TestRunOutputSep(t *testing.T) {
+	var out, errOut strings.Builder
+	code := run([]string{"--output-sep", ":", "/opt/bin", "/usr/local/bin/", "/usr/./bin"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	if want := "/opt/bin:/usr/local/bin:/usr/bin\n"; out.String() != want {
+		t.Fatalf("run output = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	code = run([]string{"--output-sep", ", ", "--no-trailing-newline", "a", "b/", "./c"}, strings.NewReader(""), &out, &errOut)
+	if want := "a, b, c"; code != 0 || out.String() != want {
+		t.Fatalf("run with --no-trailing-newline = %d, %q, want %q", code, out.String(), want)
+	}
+
+	out.Reset()
+	code = run([]string{"--output-sep", ":", "--only-existing", "/cleanpath/does/not/exist"}, strings.NewReader(""), &out, &errOut)
+	if code != 0 || out.String() != "" {
+		t.Fatalf("run with no results = %d, %q, want no output", code, out.String())
+	}
+
+	if code := run([]string{"--output-sep", ":", "-0", "-i"}, strings.NewReader("a\x00b\x00"), &out, &errOut); code != 1 {
+		t.Fatalf("run with -0 returned exit code %d, want 1", code)
+	}
+}
+
+// TestRunSlashesOnly verifies --slashes-only collapses slashes and drops . segments but keeps ..
+func TestRunSlashesOnly(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"a//b/../c"}, want: "a/c\n"},
+		{args: []string{"--slashes-only", "a//b/../c"}, want: "a/b/../c\n"},
+		{args: []string{"--slashes-only", "/./x//..//"}, want: "/x/..\n"},
+		{args: []string{"--slashes-only", "-k", "//a/./b/"}, want: "/a/b/\n"},
+		{args: []string{"--slashes-only", "./."}, want: ".\n"},
+		{args: []string{"--slashes-only", "///"}, want: "/\n"},
+		{args: []string{"--slashes-only", "../..//x"}, want: "../../x\n"},
+	}
+	for _, tc := range cases {
+		var out, errOut strings.Builder
+		code := run(tc.args, strings.NewReader(""), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("run(%q) returned exit code %d (stderr: %q)", tc.args, code, errOut.String())
+		}
+		if out.String() != tc.want {
+			t.Fatalf("run(%q) output = %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+
+	var out, errOut strings.Builder
+	if code := run([]string{"--slashes-only", "--posix", "a"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with --posix returned exit code %d, want 1", code)
+	}
+}
+
+// failingWriter rejects every write, standing in for a closed or full stdout.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// TestRunTee verifies that --tee copies stdout to a file byte for byte and that a failed
+// write on either side is reported without cutting off the other.
+func TestRunTee(t *testing.T) {
+	teePath := filepath.Join(t.TempDir(), "out.txt")
+	var out, errOut strings.Builder
+	code := run([]string{"--tee", teePath, "-i"}, strings.NewReader("/a/./b\nc//d/\n../e\n"), &out, &errOut)
+	if code != 0 {
+		t.Fatalf("run returned exit code %d (stderr: %q)", code, errOut.String())
+	}
+	data, err := os.ReadFile(teePath)
+	if err != nil {
+		t.Fatalf("reading tee file: %v", err)
+	}
+	if want := "/a/b\nc/d\n../e\n"; out.String() != want || string(data) != want {
+		t.Fatalf("stdout = %q, tee file = %q, want both %q", out.String(), data, want)
+	}
+
+	out.Reset()
+	code = run([]string{"--tee", teePath, "--output-sep", ":", "/x/", "y"}, strings.NewReader(""), &out, &errOut)
+	data, _ = os.ReadFile(teePath)
+	if code != 0 || out.String() != "/x:y\n" || string(data) != out.String() {
+		t.Fatalf("run with --output-sep = %d, stdout %q, tee file %q", code, out.String(), data)
+	}
+
+	errOut.Reset()
+	code = run([]string{"--tee", teePath, "/p/q"}, strings.NewReader(""), failingWriter{}, &errOut)
+	data, _ = os.ReadFile(teePath)
+	if code != 1 || !strings.Contains(errOut.String(), "writing stdout: broken pipe") || string(data) != "/p/q\n" {
+		t.Fatalf("run with failing stdout = %d, stderr %q, tee file %q", code, errOut.String(), data)
+	}
+
+	if code := run([]string{"--tee", t.TempDir(), "/p"}, strings.NewReader(""), &out, &errOut); code != 1 {
+		t.Fatalf("run with directory as --tee returned exit code %d, want 1", code)
+	}
+}
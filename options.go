@@ -0,0 +1,1169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cleanpath/pkg/cleanpath"
+)
+
+// stringList collects repeated flag values.
+type stringList []string
+
+// String returns a comma-separated view of the list.
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set appends a new value to the list.
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// interactiveMode is the --interactive setting: "" (off), "prompt", or "auto-yes".
+// It acts as a boolean flag so a bare --interactive means "prompt".
+type interactiveMode string
+
+// String returns the current mode.
+func (m *interactiveMode) String() string {
+	return string(*m)
+}
+
+// Set accepts true/false from a bare flag or an explicit auto-yes.
+func (m *interactiveMode) Set(value string) error {
+	switch value {
+	case "true", "prompt":
+		*m = "prompt"
+	case "false":
+		*m = ""
+	case "auto-yes":
+		*m = "auto-yes"
+	default:
+		return fmt.Errorf("invalid --interactive value: %q", value)
+	}
+	return nil
+}
+
+// IsBoolFlag lets --interactive be given without a value.
+func (m *interactiveMode) IsBoolFlag() bool {
+	return true
+}
+
+// options holds parsed CLI options and resolved runtime data.
+type options struct {
+	readInput     bool
+	fromFiles     []string
+	parallelFiles bool
+	jobs          int
+	tildeExpand   bool
+	tildeUnexpand bool
+	envExpand     bool
+	envUnexpand   bool
+	absolute      bool
+	unabsolute    bool
+	oldPatterns   []string
+	newPatterns   []string
+	user          string
+	users         []string
+	allUsers      bool
+	noGetent      bool
+	envNames      []string
+	verbose       bool
+	braceExpand   bool
+	base          string
+	baseEnv       string
+	bases         []string
+	parentRaw     string
+	maxUpRaw      string
+	newerRaw      string
+	newerFile     string
+	newerMissing  string
+	regexTimeout  time.Duration
+	fixed         bool
+	dryClean      bool
+	unique        bool
+	maxDistinct   int
+	onMaxDistinct string
+	quoteStyle    string
+	literalDash   bool
+	relPairs      bool
+	logFile       string
+	logStagesRaw  string
+	orderRaw      string
+	logTSV        bool
+	maxCount      int
+	homeSources   string
+	siblingDot    bool
+	dotSlash      bool
+	preferRel     bool
+	decodePercent bool
+	encodePercent bool
+	ancestors     bool
+	commonSuffix  bool
+	rootMarker    string
+	envWithin     string
+	lastStage     bool
+	annotate      bool
+	annotateSep   string
+	symlinkMap    string
+	rewriteFile   string
+	linkDepthRaw  string
+	targetOS      string
+	cleanEnvVals  bool
+	envSubst      bool
+	strictEnv     bool
+	winEnv        bool
+	cleanAfterEnv bool
+	prepend       string
+	appendStr     string
+	comparePairs  bool
+	compareRes    bool
+	sep           string
+	relativeToAll bool
+	warnAmbiguous bool
+	onlyExisting  bool
+	relStrict     bool
+	trimSpace     bool
+	top           int
+	homeFallback  string
+	reportWasAbs  bool
+	kind          bool
+	homeToEnv     bool
+	noCleanAbs    bool
+	caseCollide   bool
+	withBaseName  bool
+	table         bool
+	untildaRegex  bool
+	inlineOpts    bool
+	posix         bool
+	keepDouble    bool
+	slashesOnly   bool
+	renameRaw     []string
+	null          bool
+	noTrailing    bool
+	outputSep     string
+	tee           string
+	reportDepth   bool
+	windows       bool
+	logOnError    bool
+	keepTrailing  bool
+	lowercase     bool
+	dotfiles      string
+	envSnapshot   string
+	jsonOut       bool
+	cacheKey      bool
+	stats         bool
+	printBase     bool
+	devicePrefix  bool
+	reportSavings bool
+	interactive   interactiveMode
+	foldCase      bool
+	preferShorter bool
+	byteBudget    int
+	replaceExtRaw string
+	onlyMissing   bool
+	followLinks   bool
+	realpath      bool
+	markSymlinks  bool
+	diffExit      bool
+
+	homeOrder    []string
+	resolvedHome string
+	resolvedUser string
+	extraHomes   []cleanpath.Home
+	envAllowed   map[string]struct{}
+	envAll       bool
+	envOrder     []string
+	envValues    map[string]string
+	replacements []replacement
+	baseAbs      string
+	basesAbs     []string
+	parentLimit  int
+	unlimitedUp  bool
+	clampUp      bool
+	maxUp        int
+	newerFilter  bool
+	newerThan    time.Time
+	symlinks     map[string]string
+	renames      map[string]string
+	logStages    map[string]bool
+	order        []string
+	rewrites     map[string]string
+	snapshotEnv  map[string]string
+	extOld       string
+	extNew       string
+	maxLinkHops  int
+}
+
+// libOptions maps the resolved tilda and env settings onto the library's Options.
+func (o options) libOptions() cleanpath.Options {
+	return cleanpath.Options{
+		Home:           o.resolvedHome,
+		HomeFallback:   o.homeFallback,
+		User:           o.user,
+		CurrentUser:    o.resolvedUser,
+		ExtraHomes:     o.extraHomes,
+		Windows:        o.windows,
+		LookupHome:     o.lookupHome,
+		EnvAllowed:     o.envAllowed,
+		EnvAll:         o.envAll,
+		EnvSnapshot:    o.snapshotEnv,
+		CleanEnvValues: o.cleanEnvVals,
+		CleanValue:     o.cleanValue,
+		TildeDefaults:  o.tildeExpand,
+		EnvSubst:       o.envSubst,
+		WinEnv:         o.winEnv,
+		EnvOrder:       o.envOrder,
+		EnvValues:      o.envValues,
+	}
+}
+
+// cleanValue is the library's --clean-env-values cleaner: the same separator and variant
+// as the clean step.
+func (o options) cleanValue(value string) string {
+	return cleanVariant(value, o)
+}
+
+// lookupHome is the library's ~name lookup: the user database, then getent unless --no-getent.
+func (o options) lookupHome(name string) string {
+	home, _ := lookupUserHome(name, !o.noGetent)
+	return home
+}
+
+// parseArgs parses CLI flags and validates option combinations.
+func parseArgs(args []string, stdout, stderr io.Writer) (options, []string, error) {
+	var opts options
+	var envNames stringList
+	var bases stringList
+	var users stringList
+	var fromFiles stringList
+	var renames stringList
+	var oldPatterns, newPatterns stringList
+	var help bool
+	flags := flag.NewFlagSet("cleanpath", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+
+	flags.Var(&fromFiles, "f", "read paths from FILE, one per line, before the arguments (repeatable)")
+	flags.Var(&fromFiles, "from-file", "read paths from FILE, one per line, before the arguments (repeatable)")
+	flags.BoolVar(&opts.parallelFiles, "parallel-files", false, "read and transform each -f file concurrently; tag outputs with the file")
+	flags.IntVar(&opts.jobs, "jobs", 1, "transform up to N paths concurrently; output keeps input order")
+	flags.BoolVar(&opts.readInput, "i", false, "read paths from stdin, one per line")
+	flags.BoolVar(&opts.readInput, "stdin", false, "read paths from stdin, one per line")
+	flags.BoolVar(&opts.null, "0", false, "with -i or -f, read and write NUL-terminated paths")
+	flags.BoolVar(&opts.null, "null", false, "with -i or -f, read and write NUL-terminated paths")
+	flags.BoolVar(&opts.noTrailing, "no-trailing-newline", false, "omit the newline (or NUL) after the last result")
+	flags.StringVar(&opts.outputSep, "output-sep", "", "join all results with SEP on one line, e.g. : for a PATH list")
+	flags.StringVar(&opts.tee, "tee", "", "also write every result to FILE")
+	flags.BoolVar(&opts.windows, "w", false, "clean Windows paths: \\ and / separators, drive and UNC roots")
+	flags.BoolVar(&opts.windows, "windows", false, "clean Windows paths: \\ and / separators, drive and UNC roots")
+	flags.BoolVar(&opts.tildeExpand, "t", false, "expand leading tilda")
+	flags.BoolVar(&opts.tildeExpand, "tilda", false, "expand leading tilda")
+	flags.BoolVar(&opts.tildeUnexpand, "T", false, "unexpand leading tilda")
+	flags.BoolVar(&opts.tildeUnexpand, "untilda", false, "unexpand leading tilda")
+	flags.BoolVar(&opts.envExpand, "e", false, "expand environment variables")
+	flags.BoolVar(&opts.envExpand, "env", false, "expand environment variables")
+	flags.StringVar(&opts.envWithin, "env-within", "", "only expand environment variables in paths under PREFIX")
+	flags.StringVar(&opts.envSnapshot, "env-snapshot", "", "read variables for -e/-E from FILE (env output) instead of the environment")
+	flags.BoolVar(&opts.envSubst, "env-subst", false, "with -e, support ${VAR/OLD/NEW} and ${VAR//OLD/NEW} substitution")
+	flags.BoolVar(&opts.winEnv, "win-env", false, "with -e, also expand %VAR%; with -E, emit %VAR% instead of $VAR")
+	flags.BoolVar(&opts.cleanAfterEnv, "clean-after-env", false, "with -e, clean right after expansion, even when -O runs clean first")
+	flags.BoolVar(&opts.strictEnv, "strict-env", false, "with -e, fail paths that reference a variable that is not allowed or not set")
+	flags.BoolVar(&opts.cleanEnvVals, "clean-env-values", false, "clean each substituted environment variable value")
+	flags.BoolVar(&opts.envUnexpand, "E", false, "unexpand environment variables")
+	flags.BoolVar(&opts.envUnexpand, "unenv", false, "unexpand environment variables")
+	flags.BoolVar(&opts.absolute, "a", false, "make path absolute")
+	flags.BoolVar(&opts.absolute, "absolute", false, "make path absolute")
+	flags.BoolVar(&opts.unabsolute, "A", false, "make path relative")
+	flags.BoolVar(&opts.unabsolute, "unabsolute", false, "make path relative")
+	flags.Var(&oldPatterns, "o", "regex pattern to replace (repeatable, paired with -n in order)")
+	flags.Var(&oldPatterns, "old", "regex pattern to replace (repeatable, paired with -n in order)")
+	flags.Var(&newPatterns, "n", "replacement for the matching -o pattern (repeatable)")
+	flags.Var(&newPatterns, "new", "replacement for the matching -o pattern (repeatable)")
+	flags.StringVar(&opts.orderRaw, "O", "", "comma-separated order of the tilda, env, clean, absolute, and regex steps")
+	flags.StringVar(&opts.orderRaw, "order", "", "comma-separated order of the tilda, env, clean, absolute, and regex steps")
+	flags.BoolVar(&opts.untildaRegex, "unexpand-after-regex", false, "unexpand the home directory to ~ again after the regex replace")
+	flags.BoolVar(&opts.fixed, "fixed", false, "treat -o as a literal string instead of a regex")
+	flags.DurationVar(&opts.regexTimeout, "regex-timeout", 0, "maximum time for the -o replacement per path")
+	flags.StringVar(&opts.prepend, "prepend", "", "add a literal prefix to the final path")
+	flags.StringVar(&opts.appendStr, "append", "", "add a literal suffix to the final path")
+	flags.StringVar(&opts.targetOS, "target-os", "", "format output for linux, windows, or darwin")
+	flags.StringVar(&opts.sep, "sep", "", "path separator used for cleaning and -a/-A")
+	flags.StringVar(&opts.quoteStyle, "quote", "", "quote output for shell, csv, json, or c")
+	flags.BoolVar(&opts.homeToEnv, "home-to-env", false, "replace a leading home directory with $HOME")
+	flags.BoolVar(&opts.noGetent, "no-getent", false, "do not fall back to getent passwd for users the user database does not know")
+	flags.StringVar(&opts.homeFallback, "home-fallback", "", "with -t, expand ~ to DIR when no home directory is found")
+	flags.StringVar(&opts.homeSources, "home-sources", "", "ordered home sources for the current user, e.g. env:HOME,passwd")
+	flags.Var(&users, "u", "user name for tilda expansion (repeatable for unexpansion)")
+	flags.Var(&users, "user", "user name for tilda expansion (repeatable for unexpansion)")
+	flags.BoolVar(&opts.allUsers, "all-users", false, "with -T, also collapse any user's home directory to ~name (from /etc/passwd)")
+	flags.Var(&bases, "b", "base directory for absolute/relative paths (repeatable with --relative-to-all)")
+	flags.Var(&bases, "base", "base directory for absolute/relative paths (repeatable with --relative-to-all)")
+	flags.StringVar(&opts.baseEnv, "base-env", "", "use the value of environment variable NAME as the base")
+	flags.StringVar(&opts.maxUpRaw, "max-up", "", "drop leading .. segments beyond N while cleaning")
+	flags.StringVar(&opts.parentRaw, "p", "0", "maximum number of parent traversals")
+	flags.StringVar(&opts.parentRaw, "parent", "0", "maximum number of parent traversals")
+	flags.StringVar(&opts.replaceExtRaw, "replace-ext", "", "replace a trailing .OLD extension with .NEW on the final segment, as OLD=NEW")
+	flags.Var(&renames, "rename-segment", "replace path segments named OLD with NEW, as OLD=NEW (repeatable)")
+	flags.Var(&envNames, "x", "environment variable name to expand (repeatable)")
+	flags.Var(&envNames, "eXpand", "environment variable name to expand (repeatable)")
+	flags.BoolVar(&opts.unique, "q", false, "print each distinct output line only once, in first-seen order")
+	flags.BoolVar(&opts.unique, "unique", false, "print each distinct output line only once, in first-seen order")
+	flags.IntVar(&opts.maxDistinct, "max-distinct", 0, "with -q, remember at most N distinct outputs")
+	flags.StringVar(&opts.onMaxDistinct, "on-max-distinct", "error", "past --max-distinct: error (default) or passthrough without deduplication")
+	flags.BoolVar(&opts.ancestors, "ancestors", false, "emit each path's parent directories top-down, deduplicated")
+	flags.BoolVar(&opts.commonSuffix, "common-suffix", false, "emit only the trailing segments shared by every result")
+	flags.IntVar(&opts.maxCount, "max-count", 0, "stop after processing N paths")
+	flags.BoolVar(&opts.preferRel, "prefer-relative", false, "emit descendants of the base relative and everything else absolute")
+	flags.StringVar(&opts.rootMarker, "root-marker", "", "prefix relative results that are direct children of the base")
+	flags.IntVar(&opts.top, "top", 0, "keep only the first N segments of each path (the root counts as none)")
+	flags.BoolVar(&opts.siblingDot, "sibling-dot", false, "prefix ./ to relative results with no directory component")
+	flags.BoolVar(&opts.dotSlash, "dot-slash", false, "with -A, write the base itself as ./ and paths below it as ./sub/file")
+	flags.BoolVar(&opts.caseCollide, "detect-case-collisions", false, "report paths in the batch that differ only by case")
+	flags.BoolVar(&opts.comparePairs, "compare-pairs", false, "read two tab-separated paths per line and emit only pairs that differ")
+	flags.BoolVar(&opts.dryClean, "dry-clean", false, "describe what cleaning would change in each input instead of printing paths")
+	flags.BoolVar(&opts.compareRes, "compare-resolution", false, "report existing paths whose logical and physical resolutions differ")
+	flags.BoolVar(&opts.keepDouble, "keep-double-slash", false, "keep // anywhere in the path and collapse longer runs to //")
+	flags.BoolVar(&opts.slashesOnly, "slashes-only", false, "only collapse repeated slashes and drop . segments while cleaning, keeping ..")
+	flags.BoolVar(&opts.lowercase, "l", false, "lowercase each segment after cleaning, keeping ~user and $VAR forms")
+	flags.BoolVar(&opts.lowercase, "lowercase", false, "lowercase each segment after cleaning, keeping ~user and $VAR forms")
+	flags.StringVar(&opts.dotfiles, "dotfiles", "keep", "keep, strip, or flag (on stderr) .hidden segments after cleaning")
+	flags.BoolVar(&opts.keepTrailing, "k", false, "keep a trailing slash when the expanded input had one")
+	flags.BoolVar(&opts.keepTrailing, "keep-trailing", false, "keep a trailing slash when the expanded input had one")
+	flags.BoolVar(&opts.posix, "posix", false, "clean by POSIX rules: keep a leading // and a trailing /")
+	flags.BoolVar(&opts.trimSpace, "trim-space", false, "trim whitespace around the path and each segment while cleaning")
+	flags.BoolVar(&opts.noCleanAbs, "no-clean-absolute", false, "with -a, join the base and path without cleaning the result")
+	flags.BoolVar(&opts.preferShorter, "prefer-shorter", false, "with -A, keep the absolute path when the relative form is longer")
+	flags.IntVar(&opts.byteBudget, "byte-budget", 0, "with -A, emit the relative form if it fits in N bytes, else the absolute form, else fail")
+	flags.BoolVar(&opts.withBaseName, "include-base-name", false, "with -A, keep the base's last component, e.g. some-dir/a instead of a")
+	flags.BoolVar(&opts.relStrict, "relative-strict", false, "with -A, fail paths that cannot be made relative within -p")
+	flags.BoolVar(&opts.relStrict, "strict-parent", false, "same as --relative-strict")
+	flags.BoolVar(&opts.relativeToAll, "relative-to-all", false, "emit the path relative to every -b root as tab-separated columns")
+	flags.BoolVar(&opts.warnAmbiguous, "warn-ambiguous", false, "with -A and -v, log paths that several -b bases relativize equally well")
+	flags.BoolVar(&opts.relPairs, "rel-pairs", false, "read target<TAB>linkpath pairs and emit the relative symlink target")
+	flags.BoolVar(&opts.inlineOpts, "allow-inline-options", false, "apply flags from a first stdin line starting with #cleanpath:")
+	flags.BoolVar(&opts.literalDash, "literal-dash", false, "treat a '-' argument as a literal path instead of stdin")
+	flags.StringVar(&opts.rewriteFile, "rewrite-file", "", "rewrite the longest matching prefix using 'old -> new' entries in FILE")
+	flags.StringVar(&opts.symlinkMap, "symlink-map", "", "resolve .. through symlinks listed in FILE as 'link -> target'")
+	flags.StringVar(&opts.linkDepthRaw, "max-symlink-depth", "", "with --symlink-map, fail after following more than N links (default 40)")
+	flags.BoolVar(&opts.reportDepth, "report-depth-from-base", false, "append the signed depth of each path below the base")
+	flags.BoolVar(&opts.kind, "kind", false, "append dir, file, symlink, other, or missing from lstat of each path")
+	flags.BoolVar(&opts.reportWasAbs, "report-was-absolute", false, "append true or false for whether the raw input was absolute")
+	flags.BoolVar(&opts.cacheKey, "cache-key", false, "emit a stable absolute, cleaned, /-separated key (case folded for --target-os windows or darwin, default the host OS)")
+	flags.BoolVar(&opts.reportSavings, "report-savings", false, "print the total bytes trimmed from changed paths to stderr at the end")
+	flags.Var(&opts.interactive, "interactive", "confirm each changed path on the terminal (or =auto-yes to accept all)")
+	flags.BoolVar(&opts.devicePrefix, "device-prefix", false, "keep a leading scheme: or user@host: prefix, transforming only the rest")
+	flags.BoolVar(&opts.printBase, "print-base", false, "print the resolved absolute base to stderr before processing")
+	flags.BoolVar(&opts.stats, "stats", false, "print path, change, and per-step counts to stderr at the end")
+	flags.BoolVar(&opts.jsonOut, "json", false, "write one JSON object per path with its input, output, and steps")
+	flags.BoolVar(&opts.table, "table", false, "on a terminal, print aligned input | output columns (with steps under -v)")
+	flags.BoolVar(&opts.lastStage, "last-stage", false, "append the name of the last stage that changed each path")
+	flags.BoolVar(&opts.annotate, "annotate", false, "write each input and its output side by side, separated by a tab")
+	flags.StringVar(&opts.annotateSep, "annotate-sep", "", "with --annotate, separate input and output with STR instead of a tab")
+	flags.BoolVar(&opts.verbose, "v", false, "verbose logging to stderr")
+	flags.BoolVar(&opts.verbose, "verbose", false, "verbose logging to stderr")
+	flags.StringVar(&opts.logStagesRaw, "log-stages", "", "comma-separated stage names to log under -v (default all)")
+	flags.BoolVar(&opts.logOnError, "log-on-error", false, "write verbose logs only for paths that fail")
+	flags.BoolVar(&opts.logTSV, "log-tsv", false, "write verbose logs as step<TAB>from<TAB>to (implies -v)")
+	flags.StringVar(&opts.logFile, "log-file", "", "write verbose logs to FILE instead of stderr (implies -v)")
+	flags.BoolVar(&opts.decodePercent, "decode-percent", false, "decode percent-encoded bytes before other transforms")
+	flags.BoolVar(&opts.encodePercent, "percent-encode", false, "percent-encode each segment of the final path for use in a URL")
+	flags.BoolVar(&opts.braceExpand, "brace-expand", false, "expand {a,b} and {1..3} braces into multiple paths")
+	flags.BoolVar(&opts.onlyExisting, "only-existing", false, "only emit paths that exist on disk")
+	flags.BoolVar(&opts.onlyMissing, "only-missing", false, "only emit paths that do not exist on disk")
+	flags.BoolVar(&opts.diffExit, "d", false, "exit with code 10 when any output differs from its input")
+	flags.BoolVar(&opts.diffExit, "diff-exit", false, "exit with code 10 when any output differs from its input")
+	flags.BoolVar(&opts.realpath, "R", false, "resolve symlinks in the result against the filesystem")
+	flags.BoolVar(&opts.realpath, "realpath", false, "resolve symlinks in the result against the filesystem")
+	flags.BoolVar(&opts.markSymlinks, "mark-symlinks", false, "with -R, append the path components that were symlinks")
+	flags.BoolVar(&opts.followLinks, "follow-symlinks", false, "with --only-existing/--only-missing, check symlink targets")
+	flags.StringVar(&opts.newerRaw, "newer-than", "", "only emit existing paths modified after an RFC3339 time")
+	flags.StringVar(&opts.newerFile, "newer-than-file", "", "only emit existing paths modified after a reference file")
+	flags.StringVar(&opts.newerMissing, "newer-than-missing", "skip", "how to treat missing paths with --newer-than: skip or error")
+	flags.BoolVar(&help, "h", false, "show help")
+	flags.BoolVar(&help, "help", false, "show help")
+
+	if err := flags.Parse(expandCombinedArgs(args)); err != nil {
+		fmt.Fprintf(stderr, "cleanpath: %v\n", err)
+		printUsage(stderr)
+		return options{}, nil, err
+	}
+
+	opts.envNames = envNames
+	opts.fromFiles = fromFiles
+	opts.renameRaw = renames
+	opts.oldPatterns = oldPatterns
+	opts.newPatterns = newPatterns
+	if len(users) > 0 {
+		opts.user = users[len(users)-1]
+		opts.users = users
+	}
+	opts.base = "."
+	if len(bases) > 0 {
+		opts.base = bases[len(bases)-1]
+		opts.bases = bases
+	}
+	if (opts.logFile != "" || opts.logTSV) && !opts.logOnError {
+		opts.verbose = true
+	}
+
+	if help {
+		printUsage(stdout)
+		return options{}, nil, errHelp
+	}
+
+	if err := prepareOptions(&opts); err != nil {
+		fmt.Fprintf(stderr, "cleanpath: %v\n", err)
+		printUsage(stderr)
+		return options{}, nil, err
+	}
+
+	return opts, flags.Args(), nil
+}
+
+// expandCombinedArgs expands grouped short flags like -iT and handles -bVALUE forms.
+func expandCombinedArgs(args []string) []string {
+	valueFlags := map[rune]bool{
+		'O': true,
+		'b': true,
+		'f': true,
+		'n': true,
+		'o': true,
+		'p': true,
+		'u': true,
+		'x': true,
+	}
+	var out []string
+	for _, arg := range args {
+		if len(arg) < 3 || !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "--") {
+			out = append(out, arg)
+			continue
+		}
+
+		rest := arg[1:]
+		for i, r := range rest {
+			if r == '-' {
+				out = append(out, arg)
+				break
+			}
+			out = append(out, "-"+string(r))
+			if valueFlags[r] {
+				if i+1 < len(rest) {
+					out = append(out, rest[i+1:])
+				}
+				break
+			}
+		}
+	}
+	return out
+}
+
+// printUsage prints a brief CLI usage message.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: cleanpath [options] <path> [path ...]")
+	fmt.Fprintln(w, "options:")
+	fmt.Fprintln(w, "  -a, --absolute       make path absolute")
+	fmt.Fprintln(w, "      --no-clean-absolute")
+	fmt.Fprintln(w, "                       with -a, join the base and path without cleaning the result")
+	fmt.Fprintln(w, "      --append  STR    add a literal suffix to the final path")
+	fmt.Fprintln(w, "  -A, --unabsolute     make path relative")
+	fmt.Fprintln(w, "      --ancestors      emit every parent directory before each path, deduplicated")
+	fmt.Fprintln(w, "      --common-suffix  emit only the trailing segments shared by every result")
+	fmt.Fprintln(w, "  -q, --unique         print each distinct output line once, in first-seen order")
+	fmt.Fprintln(w, "      --max-distinct N")
+	fmt.Fprintln(w, "                       with -q, remember at most N distinct outputs")
+	fmt.Fprintln(w, "      --on-max-distinct ACTION")
+	fmt.Fprintln(w, "                       past --max-distinct: error (default) or passthrough without deduplication")
+	fmt.Fprintln(w, "  -b, --base    DIR    base directory for absolute/relative paths (default '.', last one wins)")
+	fmt.Fprintln(w, "      --base-env NAME")
+	fmt.Fprintln(w, "                       use the value of environment variable NAME as the base")
+	fmt.Fprintln(w, "      --print-base     print the resolved absolute base to stderr before processing")
+	fmt.Fprintln(w, "      --brace-expand   expand {a,b} and {1..3} braces into multiple paths")
+	fmt.Fprintln(w, "      --compare-pairs  read path<TAB>path lines and emit only pairs that differ (exit 4)")
+	fmt.Fprintln(w, "      --compare-resolution")
+	fmt.Fprintln(w, "                       report inputs whose lexical and symlink-resolved forms differ")
+	fmt.Fprintln(w, "      --dry-clean      print what cleaning would change in each input instead of the path")
+	fmt.Fprintln(w, "      --decode-percent")
+	fmt.Fprintln(w, "                       decode percent-encoded bytes before other transforms")
+	fmt.Fprintln(w, "      --percent-encode")
+	fmt.Fprintln(w, "                       percent-encode each segment of the final path for use in a URL")
+	fmt.Fprintln(w, "      --detect-case-collisions")
+	fmt.Fprintln(w, "                       report paths that differ only by case (exit 5)")
+	fmt.Fprintln(w, "  -d, --diff-exit      report whether any output differs from its input (exit 10)")
+	fmt.Fprintln(w, "      --newer-than TIME")
+	fmt.Fprintln(w, "                       only emit existing paths modified after an RFC3339 time")
+	fmt.Fprintln(w, "      --newer-than-file FILE")
+	fmt.Fprintln(w, "                       only emit existing paths modified after FILE")
+	fmt.Fprintln(w, "      --newer-than-missing MODE")
+	fmt.Fprintln(w, "                       missing paths with --newer-than: skip (default) or error")
+	fmt.Fprintln(w, "      --only-existing  only emit paths that exist on disk")
+	fmt.Fprintln(w, "      --only-missing   only emit paths that do not exist on disk")
+	fmt.Fprintln(w, "      --follow-symlinks")
+	fmt.Fprintln(w, "                       check symlink targets rather than the links themselves")
+	fmt.Fprintln(w, "  -R, --realpath       resolve symlinks in the result on disk (unlike cleaning, reads the filesystem)")
+	fmt.Fprintln(w, "      --mark-symlinks  with -R, append a tab and links=NAME,... for the components that were symlinks")
+	fmt.Fprintln(w, "  -e, --env            expand environment variables")
+	fmt.Fprintln(w, "      --env-within PREFIX")
+	fmt.Fprintln(w, "                       only expand environment variables in paths under PREFIX")
+	fmt.Fprintln(w, "      --clean-env-values")
+	fmt.Fprintln(w, "                       clean each substituted environment variable value")
+	fmt.Fprintln(w, "      --env-subst      with -e, support ${VAR/OLD/NEW} and ${VAR//OLD/NEW}")
+	fmt.Fprintln(w, "      --win-env        with -e, also expand %VAR%; with -E, emit %VAR% instead of $VAR")
+	fmt.Fprintln(w, "      --clean-after-env")
+	fmt.Fprintln(w, "                       with -e, clean right after expansion, even when -O runs clean first")
+	fmt.Fprintln(w, "      --strict-env     with -e, fail paths that reference a variable that is not allowed or not set")
+	fmt.Fprintln(w, "      --env-snapshot FILE")
+	fmt.Fprintln(w, "                       read -e/-E values from FILE (env output), ignoring the environment")
+	fmt.Fprintln(w, "  -E, --unenv          unexpand environment variables")
+	fmt.Fprintln(w, "  -h, --help           show help and exit")
+	fmt.Fprintln(w, "  -i, --stdin          read paths from stdin, one per line")
+	fmt.Fprintln(w, "  -f, --from-file FILE")
+	fmt.Fprintln(w, "                       read paths from FILE, one per line, before any arguments (repeatable)")
+	fmt.Fprintln(w, "      --parallel-files")
+	fmt.Fprintln(w, "                       read and transform each -f file concurrently; tag outputs with the file")
+	fmt.Fprintln(w, "      --jobs    N      transform up to N paths concurrently; output keeps input order")
+	fmt.Fprintln(w, "  -0, --null           with -i or -f, read and write NUL-terminated paths")
+	fmt.Fprintln(w, "      --no-trailing-newline")
+	fmt.Fprintln(w, "                       omit the newline (or NUL) after the last result")
+	fmt.Fprintln(w, "      --output-sep SEP")
+	fmt.Fprintln(w, "                       join all results with SEP on one line, e.g. : for a PATH list")
+	fmt.Fprintln(w, "      --tee     FILE   also write every result to FILE")
+	fmt.Fprintln(w, "      --literal-dash   treat a '-' argument as a path instead of stdin")
+	fmt.Fprintln(w, "      --allow-inline-options")
+	fmt.Fprintln(w, "                       apply flags from a first stdin line starting with #cleanpath:")
+	fmt.Fprintln(w, "      --max-count N")
+	fmt.Fprintln(w, "                       stop after processing N paths (exit code 3 if more remain)")
+	fmt.Fprintln(w, "      --max-up  N      drop leading .. segments beyond N while cleaning")
+	fmt.Fprintln(w, "  -n, --new     NEW    replacement for the matching -o (repeatable, paired in order)")
+	fmt.Fprintln(w, "  -o, --old     OLD    regex pattern to replace (repeatable)")
+	fmt.Fprintln(w, "      --fixed          treat -o as a literal string rather than a regex")
+	fmt.Fprintln(w, "  -O, --order   LIST   reorder the tilda,env,clean,absolute,regex steps (listed ones run as a block)")
+	fmt.Fprintln(w, "  -p, --parent  COUNT  maximum parent traversals for relative paths (default 0, '-' unlimited)")
+	fmt.Fprintln(w, "      --prepend STR")
+	fmt.Fprintln(w, "                       add a literal prefix to the final path")
+	fmt.Fprintln(w, "      --prefer-relative")
+	fmt.Fprintln(w, "                       emit descendants of the base relative, everything else absolute")
+	fmt.Fprintln(w, "      --top     N      keep only the first N segments of each path (the root counts as none)")
+	fmt.Fprintln(w, "      --quote   STYLE  quote output for shell, csv, json, or c")
+	fmt.Fprintln(w, "      --home-sources LIST")
+	fmt.Fprintln(w, "                       ordered home sources for ~, e.g. env:HOME,env:USERPROFILE,passwd")
+	fmt.Fprintln(w, "      --home-fallback DIR")
+	fmt.Fprintln(w, "                       with -t, expand ~ to DIR when no home directory is found")
+	fmt.Fprintln(w, "      --no-getent      do not fall back to getent passwd for users the user database does not know")
+	fmt.Fprintln(w, "      --regex-timeout DURATION")
+	fmt.Fprintln(w, "                       maximum time for the -o replacement per path (e.g. 500ms)")
+	fmt.Fprintln(w, "      --unexpand-after-regex")
+	fmt.Fprintln(w, "                       collapse the home directory to ~ again after -o/-n")
+	fmt.Fprintln(w, "      --rel-pairs      read target<TAB>linkpath lines and emit the relative link target")
+	fmt.Fprintln(w, "      --relative-to-all")
+	fmt.Fprintln(w, "                       emit one tab-separated column per -b root containing the path")
+	fmt.Fprintln(w, "      --warn-ambiguous")
+	fmt.Fprintln(w, "                       with -A and -v, log paths that several -b bases relativize equally well")
+	fmt.Fprintln(w, "      --rename-segment OLD=NEW")
+	fmt.Fprintln(w, "                       replace segments named exactly OLD with NEW (repeatable)")
+	fmt.Fprintln(w, "      --replace-ext OLD=NEW")
+	fmt.Fprintln(w, "                       swap a trailing .OLD extension for .NEW on the last segment")
+	fmt.Fprintln(w, "      --relative-strict")
+	fmt.Fprintln(w, "                       with -A, fail paths that cannot be made relative within -p")
+	fmt.Fprintln(w, "      --strict-parent  same as --relative-strict")
+	fmt.Fprintln(w, "      --include-base-name")
+	fmt.Fprintln(w, "                       with -A, keep the base's last component (some-dir/a instead of a)")
+	fmt.Fprintln(w, "      --prefer-shorter")
+	fmt.Fprintln(w, "                       with -A, keep the absolute path when the relative form is longer")
+	fmt.Fprintln(w, "      --byte-budget N")
+	fmt.Fprintln(w, "                       with -A, emit the relative form if it fits in N bytes, else the absolute form, else fail")
+	fmt.Fprintln(w, "      --sep     CHAR   segment separator for cleaning and -a/-A (default '/')")
+	fmt.Fprintln(w, "      --trim-space     trim whitespace around the path and each segment while cleaning")
+	fmt.Fprintln(w, "      --posix          clean by POSIX rules: keep a leading // and a trailing /")
+	fmt.Fprintln(w, "      --keep-double-slash")
+	fmt.Fprintln(w, "                       keep // anywhere in the path, collapsing longer runs to //")
+	fmt.Fprintln(w, "      --slashes-only   only collapse repeated slashes and drop . segments while cleaning, keeping ..")
+	fmt.Fprintln(w, "      --device-prefix  keep a leading scheme: or user@host: prefix, transforming only the rest")
+	fmt.Fprintln(w, "  -k, --keep-trailing  keep a trailing slash when the expanded input had one")
+	fmt.Fprintln(w, "  -l, --lowercase      lowercase each segment after cleaning, keeping ~user, $VAR, and drive roots")
+	fmt.Fprintln(w, "      --dotfiles POLICY")
+	fmt.Fprintln(w, "                       keep, strip, or flag (on stderr) .hidden segments after cleaning (default keep)")
+	fmt.Fprintln(w, "      --root-marker STR")
+	fmt.Fprintln(w, "                       prefix relative results that are direct children of the base")
+	fmt.Fprintln(w, "      --sibling-dot    prefix ./ to relative results with no directory component")
+	fmt.Fprintln(w, "      --dot-slash      with -A, write the base itself as ./ and paths below it as ./sub/file")
+	fmt.Fprintln(w, "      --symlink-map FILE")
+	fmt.Fprintln(w, "                       resolve .. through 'link -> target' entries in FILE (no filesystem access)")
+	fmt.Fprintln(w, "      --max-symlink-depth N")
+	fmt.Fprintln(w, "                       with --symlink-map, fail after following more than N links (default 40)")
+	fmt.Fprintln(w, "      --rewrite-file FILE")
+	fmt.Fprintln(w, "                       replace the longest matching prefix from 'old -> new' lines in FILE")
+	fmt.Fprintln(w, "  -t, --tilda          expand leading tilda")
+	fmt.Fprintln(w, "  -T, --untilda        unexpand leading tilda")
+	fmt.Fprintln(w, "      --home-to-env    replace a leading home directory with $HOME (segment-aligned)")
+	fmt.Fprintln(w, "      --target-os OS")
+	fmt.Fprintln(w, "                       format output separators for linux, windows, or darwin (the last two compare ignoring case)")
+	fmt.Fprintln(w, "  -u, --user    USER   user name for tilda expansion (repeatable for unexpansion)")
+	fmt.Fprintln(w, "      --all-users      with -T, also collapse any user's home directory to ~name (from /etc/passwd)")
+	fmt.Fprintln(w, "  -v, --verbose        verbose logging to stderr")
+	fmt.Fprintln(w, "      --last-stage     append a tab and the name of the last stage that changed the path")
+	fmt.Fprintln(w, "      --annotate       write each input and its output side by side, separated by a tab")
+	fmt.Fprintln(w, "      --annotate-sep STR")
+	fmt.Fprintln(w, "                       with --annotate, separate input and output with STR instead of a tab")
+	fmt.Fprintln(w, "      --stats          print path, change, and per-step counts to stderr at the end")
+	fmt.Fprintln(w, "      --report-savings")
+	fmt.Fprintln(w, "                       print the total bytes trimmed from changed paths to stderr at the end")
+	fmt.Fprintln(w, "      --interactive    confirm each changed path on the terminal (=auto-yes accepts all)")
+	fmt.Fprintln(w, "      --report-was-absolute")
+	fmt.Fprintln(w, "                       append true or false for whether the raw input was absolute")
+	fmt.Fprintln(w, "      --report-depth-from-base")
+	fmt.Fprintln(w, "                       append the signed depth of each path below the base")
+	fmt.Fprintln(w, "      --kind           append dir, file, symlink, other, or missing (lstat, reads the filesystem)")
+	fmt.Fprintln(w, "      --table          on a terminal, print aligned input | output columns (steps under -v)")
+	fmt.Fprintln(w, "      --json           write one JSON object per path with its input, output, and steps")
+	fmt.Fprintln(w, "      --cache-key      emit a stable comparison key: absolute, cleaned, / separators")
+	fmt.Fprintln(w, "                       (case folded for --target-os windows or darwin, default the host OS)")
+	fmt.Fprintln(w, "      --log-file FILE")
+	fmt.Fprintln(w, "                       write verbose logs to FILE instead of stderr (implies -v)")
+	fmt.Fprintln(w, "      --log-tsv        write verbose logs as step<TAB>from<TAB>to (implies -v)")
+	fmt.Fprintln(w, "      --log-stages LIST")
+	fmt.Fprintln(w, "                       only log these comma-separated stages under -v (e.g. env,regex)")
+	fmt.Fprintln(w, "      --log-on-error   write verbose logs only for paths that fail")
+	fmt.Fprintln(w, "  -w, --windows        clean Windows paths: \\ and / separators, drive and UNC roots")
+	fmt.Fprintln(w, "  -x, --eXpand  NAME   environment variable name to expand (repeatable, '-' means all)")
+	fmt.Fprintln(w, "environment:")
+	fmt.Fprintln(w, "  CLEANPATH_VARS       comma-separated -x names used when no -x is given")
+}
+
+// prepareOptions validates option combinations and resolves derived data.
+func prepareOptions(opts *options) error {
+	if opts.windows {
+		if opts.sep != "" || opts.posix || opts.keepDouble {
+			return fmt.Errorf("option -w cannot be combined with --sep, --posix, or --keep-double-slash")
+		}
+		if opts.absolute || opts.unabsolute || opts.preferRel || opts.relPairs || opts.relativeToAll || opts.reportDepth || opts.printBase {
+			return fmt.Errorf("option -w does not support base-relative options (-a, -A, --prefer-relative, --rel-pairs, --relative-to-all, --report-depth-from-base, --print-base)")
+		}
+		opts.sep = `\`
+	}
+	if opts.cacheKey {
+		if opts.windows || opts.sep != "" || opts.posix || opts.keepDouble || opts.keepTrailing ||
+			opts.unabsolute || opts.preferRel || opts.noCleanAbs {
+			return fmt.Errorf("option --cache-key cannot be combined with -w, --sep, --posix, --keep-double-slash, -k, -A, --prefer-relative, or --no-clean-absolute")
+		}
+		// The key always uses /, so --target-os only decides whether case is folded. Without
+		// it the host OS decides, so keys match the filesystem they are computed on.
+		opts.absolute = true
+		target := opts.targetOS
+		if target == "" {
+			target = runtime.GOOS
+		}
+		opts.foldCase = target == "windows" || target == "darwin"
+		if opts.foldCase || opts.targetOS == "linux" {
+			opts.targetOS = ""
+		}
+	}
+	if opts.sep == "" {
+		opts.sep = "/"
+	}
+	if utf8.RuneCountInString(opts.sep) != 1 || opts.sep == "." {
+		return fmt.Errorf("invalid --sep value: %q", opts.sep)
+	}
+	if opts.tildeExpand && opts.tildeUnexpand {
+		return fmt.Errorf("cannot use -t and -T together")
+	}
+	if opts.envExpand && opts.envUnexpand {
+		return fmt.Errorf("cannot use -e and -E together")
+	}
+	if opts.homeToEnv && (opts.tildeUnexpand || opts.envExpand) {
+		return fmt.Errorf("option --home-to-env cannot be combined with -T or -e")
+	}
+	if opts.absolute && opts.unabsolute {
+		return fmt.Errorf("cannot use -a and -A together")
+	}
+	if opts.preferShorter && !opts.unabsolute {
+		return fmt.Errorf("option --prefer-shorter requires -A")
+	}
+	if opts.byteBudget < 0 {
+		return fmt.Errorf("invalid --byte-budget value: %d", opts.byteBudget)
+	}
+	if opts.byteBudget > 0 && !opts.unabsolute {
+		return fmt.Errorf("option --byte-budget requires -A")
+	}
+	if opts.warnAmbiguous && (!opts.unabsolute || !opts.verbose) {
+		return fmt.Errorf("option --warn-ambiguous requires -A and -v")
+	}
+	if opts.warnAmbiguous && len(opts.bases) > 1 {
+		for _, base := range opts.bases {
+			var baseAbs string
+			var err error
+			if opts.sep == "/" {
+				baseAbs, err = resolveBaseAbs(base)
+			} else {
+				baseAbs, err = resolveBaseAbsSep(base, opts.sep)
+			}
+			if err != nil {
+				return err
+			}
+			opts.basesAbs = append(opts.basesAbs, baseAbs)
+		}
+	}
+	if opts.rootMarker != "" && !opts.unabsolute && !opts.preferRel {
+		return fmt.Errorf("option --root-marker requires -A or --prefer-relative")
+	}
+	if opts.dotSlash && !opts.unabsolute {
+		return fmt.Errorf("option --dot-slash requires -A")
+	}
+	if opts.withBaseName && !opts.unabsolute {
+		return fmt.Errorf("option --include-base-name requires -A")
+	}
+	if opts.relStrict && !opts.unabsolute {
+		return fmt.Errorf("option --relative-strict (--strict-parent) requires -A")
+	}
+	if opts.reportDepth && opts.relativeToAll {
+		return fmt.Errorf("cannot use --report-depth-from-base and --relative-to-all together")
+	}
+	if opts.jsonOut && (opts.quoteStyle != "" || opts.table || opts.lastStage || opts.reportWasAbs || opts.reportDepth || opts.kind || opts.markSymlinks || opts.relativeToAll) {
+		return fmt.Errorf("option --json cannot be combined with --quote, --table, --last-stage, --report-*, --kind, --mark-symlinks, or --relative-to-all")
+	}
+	if opts.outputSep != "" && (opts.null || opts.table) {
+		return fmt.Errorf("option --output-sep cannot be combined with -0 or --table")
+	}
+	if opts.annotateSep != "" && !opts.annotate {
+		return fmt.Errorf("option --annotate-sep requires --annotate")
+	}
+	if opts.annotate {
+		if opts.jsonOut || opts.table || opts.dryClean || opts.commonSuffix {
+			return fmt.Errorf("option --annotate cannot be combined with --json, --table, --dry-clean, or --common-suffix")
+		}
+		if opts.annotateSep == "" {
+			opts.annotateSep = "\t"
+		}
+	}
+	if opts.commonSuffix && (opts.jsonOut || opts.table || opts.dryClean || opts.ancestors || opts.relativeToAll || opts.parallelFiles ||
+		opts.lastStage || opts.reportWasAbs || opts.reportDepth || opts.kind || opts.markSymlinks) {
+		return fmt.Errorf("option --common-suffix cannot be combined with --json, --table, --dry-clean, --ancestors, --relative-to-all, --parallel-files, --last-stage, --report-*, --kind, or --mark-symlinks")
+	}
+	if opts.null && !opts.readInput && len(opts.fromFiles) == 0 {
+		return fmt.Errorf("option -0 requires -i or -f")
+	}
+	if opts.jobs < 0 {
+		return fmt.Errorf("invalid --jobs value: %d", opts.jobs)
+	}
+	if opts.parallelFiles && len(opts.fromFiles) == 0 {
+		return fmt.Errorf("option --parallel-files requires -f")
+	}
+	if opts.parallelFiles && (opts.jsonOut || opts.table || opts.dryClean) {
+		return fmt.Errorf("option --parallel-files cannot be combined with --json, --table, or --dry-clean")
+	}
+	if opts.noCleanAbs && !opts.absolute {
+		return fmt.Errorf("option --no-clean-absolute requires -a")
+	}
+	if opts.preferRel && (opts.absolute || opts.unabsolute) {
+		return fmt.Errorf("cannot use --prefer-relative with -a or -A")
+	}
+	if opts.onlyExisting && opts.onlyMissing {
+		return fmt.Errorf("cannot use --only-existing and --only-missing together")
+	}
+	if opts.relPairs && opts.comparePairs {
+		return fmt.Errorf("cannot use --rel-pairs and --compare-pairs together")
+	}
+	if opts.relPairs && opts.unabsolute {
+		return fmt.Errorf("cannot use --rel-pairs and -A together")
+	}
+	if len(opts.oldPatterns) > 0 && len(opts.newPatterns) == 0 {
+		return fmt.Errorf("option -o requires -n")
+	}
+	if len(opts.newPatterns) > 0 && len(opts.oldPatterns) == 0 {
+		return fmt.Errorf("option -n requires -o")
+	}
+	if len(opts.oldPatterns) != len(opts.newPatterns) {
+		return fmt.Errorf("got %d -o patterns but %d -n replacements", len(opts.oldPatterns), len(opts.newPatterns))
+	}
+	if opts.dryClean && (opts.jsonOut || opts.table || opts.relPairs || opts.comparePairs) {
+		return fmt.Errorf("option --dry-clean cannot be combined with --json, --table, --rel-pairs, or --compare-pairs")
+	}
+	if opts.logStagesRaw != "" {
+		opts.logStages = map[string]bool{}
+		for _, name := range strings.Split(opts.logStagesRaw, ",") {
+			name = strings.TrimSpace(name)
+			if !slices.Contains(stageNames, name) {
+				return fmt.Errorf("invalid --log-stages entry: %q", name)
+			}
+			opts.logStages[name] = true
+		}
+	}
+	if opts.orderRaw != "" {
+		order, err := resolveOrder(opts.orderRaw)
+		if err != nil {
+			return err
+		}
+		opts.order = order
+	}
+	if opts.fixed && len(opts.oldPatterns) == 0 {
+		return fmt.Errorf("option --fixed requires -o")
+	}
+	if opts.untildaRegex && len(opts.oldPatterns) == 0 {
+		return fmt.Errorf("option --unexpand-after-regex requires -o")
+	}
+
+	if opts.homeSources != "" {
+		order, err := parseHomeSources(opts.homeSources)
+		if err != nil {
+			return err
+		}
+		opts.homeOrder = order
+	}
+	if opts.windows && opts.homeOrder == nil {
+		opts.homeOrder = windowsHomeSources
+	}
+
+	if opts.tildeExpand || opts.tildeUnexpand || opts.homeToEnv || opts.untildaRegex {
+		home, name := resolveUserHome(opts.user, opts.homeOrder, opts.windows, !opts.noGetent)
+		opts.resolvedHome = home
+		opts.resolvedUser = name
+	}
+	if opts.homeFallback != "" {
+		if !opts.tildeExpand {
+			return fmt.Errorf("option --home-fallback requires -t")
+		}
+		opts.homeFallback = cleanpath.Clean(opts.homeFallback)
+	}
+
+	// Earlier -u users are extra unexpansion candidates; the last -u is the primary user.
+	if opts.tildeUnexpand && len(opts.users) > 1 {
+		for _, name := range opts.users[:len(opts.users)-1] {
+			home, resolved := resolveUserHome(name, opts.homeOrder, opts.windows, !opts.noGetent)
+			if resolved == "" || name == opts.user {
+				continue
+			}
+			opts.extraHomes = append(opts.extraHomes, cleanpath.Home{Dir: home, Prefix: "~" + name})
+		}
+	}
+	if opts.allUsers {
+		if !opts.tildeUnexpand {
+			return fmt.Errorf("option --all-users requires -T")
+		}
+		if opts.windows {
+			return fmt.Errorf("option --all-users cannot be combined with -w")
+		}
+		homes, err := loadPasswdHomes(passwdFile, opts.resolvedHome)
+		if err != nil {
+			return err
+		}
+		opts.extraHomes = append(opts.extraHomes, homes...)
+	}
+
+	// CLEANPATH_VARS supplies the -x list when no -x flags are given.
+	if len(opts.envNames) == 0 {
+		for _, name := range strings.Split(os.Getenv("CLEANPATH_VARS"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.envNames = append(opts.envNames, name)
+			}
+		}
+	}
+
+	environ := os.Environ()
+	if opts.envSnapshot != "" {
+		if !opts.envExpand && !opts.envUnexpand {
+			return fmt.Errorf("option --env-snapshot requires -e or -E")
+		}
+		entries, err := loadEnvSnapshot(opts.envSnapshot)
+		if err != nil {
+			return err
+		}
+		environ = entries
+		opts.snapshotEnv = make(map[string]string, len(entries))
+		for _, entry := range entries {
+			name, value, _ := strings.Cut(entry, "=")
+			opts.snapshotEnv[name] = value
+		}
+	}
+
+	if opts.envExpand || opts.envUnexpand {
+		order, values := envOrderAndValues(opts.envNames, opts.envExpand, environ)
+		opts.envOrder = order
+		opts.envValues = values
+		opts.envAllowed = make(map[string]struct{}, len(order))
+		for _, name := range order {
+			opts.envAllowed[name] = struct{}{}
+		}
+		// With every variable eligible, unset ones still take a ${VAR:-WORD} default.
+		opts.envAll = opts.envExpand && (containsAllMarker(opts.envNames) || len(opts.envNames) == 0)
+	}
+
+	if opts.winEnv && !opts.envExpand && !opts.envUnexpand {
+		return fmt.Errorf("option --win-env requires -e or -E")
+	}
+	if opts.cleanAfterEnv && !opts.envExpand {
+		return fmt.Errorf("option --clean-after-env requires -e")
+	}
+	if opts.strictEnv && !opts.envExpand {
+		return fmt.Errorf("option --strict-env requires -e")
+	}
+	if opts.envSubst && !opts.envExpand {
+		return fmt.Errorf("option --env-subst requires -e")
+	}
+	if opts.envWithin != "" {
+		if !opts.envExpand {
+			return fmt.Errorf("option --env-within requires -e")
+		}
+		opts.envWithin = cleanpath.Clean(opts.envWithin)
+	}
+
+	if opts.maxUpRaw != "" {
+		limit, err := strconv.Atoi(opts.maxUpRaw)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("invalid --max-up value: %q", opts.maxUpRaw)
+		}
+		opts.clampUp = true
+		opts.maxUp = limit
+	}
+
+	if opts.parentRaw != "" {
+		limit, unlimited, err := parseParentLimit(opts.parentRaw)
+		if err != nil {
+			return err
+		}
+		opts.parentLimit = limit
+		opts.unlimitedUp = unlimited
+	}
+
+	if opts.posix && opts.sep != "/" {
+		return fmt.Errorf("option --posix cannot be combined with --sep")
+	}
+	if opts.keepDouble && (opts.posix || opts.sep != "/") {
+		return fmt.Errorf("option --keep-double-slash cannot be combined with --posix or --sep")
+	}
+	if opts.slashesOnly && (opts.windows || opts.posix || opts.keepDouble || opts.cacheKey || opts.dryClean) {
+		return fmt.Errorf("option --slashes-only cannot be combined with -w, --posix, --keep-double-slash, --cache-key, or --dry-clean")
+	}
+	if opts.devicePrefix && (opts.windows || opts.realpath || opts.kind) {
+		return fmt.Errorf("option --device-prefix cannot be combined with -w, -R, or --kind")
+	}
+	if opts.markSymlinks && !opts.realpath {
+		return fmt.Errorf("option --mark-symlinks requires -R")
+	}
+	if opts.realpath && opts.sep != "/" {
+		return fmt.Errorf("option -R cannot be combined with --sep or -w")
+	}
+	if opts.kind && opts.sep != "/" {
+		return fmt.Errorf("option --kind cannot be combined with --sep or -w")
+	}
+	if opts.relativeToAll {
+		if len(opts.bases) == 0 {
+			return fmt.Errorf("option --relative-to-all requires at least one -b")
+		}
+		if opts.sep != "/" {
+			return fmt.Errorf("cannot use --relative-to-all with --sep")
+		}
+		// --warn-ambiguous may already have resolved every -b.
+		for _, base := range opts.bases[len(opts.basesAbs):] {
+			baseAbs, err := resolveBaseAbs(base)
+			if err != nil {
+				return err
+			}
+			opts.basesAbs = append(opts.basesAbs, baseAbs)
+		}
+	}
+
+	for _, spec := range opts.renameRaw {
+		oldName, newName, ok := strings.Cut(spec, "=")
+		if !ok || oldName == "" || newName == "" || oldName == "." || oldName == ".." ||
+			strings.Contains(oldName, opts.sep) || strings.Contains(newName, opts.sep) {
+			return fmt.Errorf("invalid --rename-segment value: %q", spec)
+		}
+		if opts.renames == nil {
+			opts.renames = map[string]string{}
+		}
+		opts.renames[oldName] = newName
+	}
+
+	if opts.replaceExtRaw != "" {
+		oldExt, newExt, ok := strings.Cut(opts.replaceExtRaw, "=")
+		oldExt = strings.TrimPrefix(oldExt, ".")
+		newExt = strings.TrimPrefix(newExt, ".")
+		if !ok || oldExt == "" || newExt == "" || strings.Contains(oldExt+newExt, opts.sep) {
+			return fmt.Errorf("invalid --replace-ext value: %q", opts.replaceExtRaw)
+		}
+		opts.extOld = "." + oldExt
+		opts.extNew = "." + newExt
+	}
+
+	if opts.rewriteFile != "" {
+		rewrites, err := loadRewriteFile(opts.rewriteFile, opts.sep)
+		if err != nil {
+			return err
+		}
+		opts.rewrites = rewrites
+	}
+
+	if opts.symlinkMap != "" {
+		links, err := loadSymlinkMap(opts.symlinkMap)
+		if err != nil {
+			return err
+		}
+		opts.symlinks = links
+	}
+	opts.maxLinkHops = maxSymlinkHops
+	if opts.linkDepthRaw != "" {
+		if opts.symlinkMap == "" {
+			return fmt.Errorf("option --max-symlink-depth requires --symlink-map")
+		}
+		depth, err := strconv.Atoi(opts.linkDepthRaw)
+		if err != nil || depth < 0 {
+			return fmt.Errorf("invalid --max-symlink-depth value: %q", opts.linkDepthRaw)
+		}
+		opts.maxLinkHops = depth
+	}
+
+	if opts.baseEnv != "" {
+		if len(opts.bases) > 0 {
+			return fmt.Errorf("cannot use --base-env with -b")
+		}
+		value, ok := os.LookupEnv(opts.baseEnv)
+		if !ok || value == "" {
+			return fmt.Errorf("option --base-env: $%s is not set", opts.baseEnv)
+		}
+		opts.base = value
+	}
+	if opts.absolute || opts.unabsolute || opts.relPairs || opts.preferRel || opts.symlinkMap != "" || opts.relativeToAll ||
+		opts.onlyExisting || opts.onlyMissing || opts.newerRaw != "" || opts.newerFile != "" || opts.reportDepth || opts.realpath || opts.kind || opts.printBase || opts.compareRes {
+		var baseAbs string
+		var err error
+		if opts.sep == "/" {
+			baseAbs, err = resolveBaseAbs(opts.base)
+		} else {
+			baseAbs, err = resolveBaseAbsSep(opts.base, opts.sep)
+		}
+		if err != nil {
+			return err
+		}
+		opts.baseAbs = baseAbs
+	}
+
+	switch opts.dotfiles {
+	case "", "keep", "strip", "flag":
+	default:
+		return fmt.Errorf("invalid --dotfiles value: %q (want keep, strip, or flag)", opts.dotfiles)
+	}
+	if opts.encodePercent && opts.targetOS == "windows" {
+		return fmt.Errorf("option --percent-encode cannot be combined with --target-os windows")
+	}
+	switch opts.targetOS {
+	case "", "linux", "windows", "darwin":
+	default:
+		return fmt.Errorf("invalid --target-os value: %q", opts.targetOS)
+	}
+	switch opts.quoteStyle {
+	case "", "shell", "csv", "json", "c":
+	default:
+		return fmt.Errorf("invalid --quote style: %q", opts.quoteStyle)
+	}
+	if opts.top < 0 {
+		return fmt.Errorf("invalid --top value: %d", opts.top)
+	}
+	if opts.maxCount < 0 {
+		return fmt.Errorf("invalid --max-count value: %d", opts.maxCount)
+	}
+	if opts.regexTimeout < 0 {
+		return fmt.Errorf("invalid --regex-timeout value: %v", opts.regexTimeout)
+	}
+	if opts.newerRaw != "" && opts.newerFile != "" {
+		return fmt.Errorf("cannot use --newer-than and --newer-than-file together")
+	}
+	if opts.maxDistinct < 0 {
+		return fmt.Errorf("invalid --max-distinct value: %d", opts.maxDistinct)
+	}
+	if opts.maxDistinct > 0 && !opts.unique {
+		return fmt.Errorf("option --max-distinct requires -q")
+	}
+	if opts.onMaxDistinct != "" && opts.onMaxDistinct != "error" && opts.onMaxDistinct != "passthrough" {
+		return fmt.Errorf("invalid --on-max-distinct value: %q", opts.onMaxDistinct)
+	}
+	if opts.newerMissing != "" && opts.newerMissing != "skip" && opts.newerMissing != "error" {
+		return fmt.Errorf("invalid --newer-than-missing value: %q", opts.newerMissing)
+	}
+	if opts.newerRaw != "" {
+		newer, err := time.Parse(time.RFC3339, opts.newerRaw)
+		if err != nil {
+			return fmt.Errorf("invalid --newer-than time: %q", opts.newerRaw)
+		}
+		opts.newerFilter = true
+		opts.newerThan = newer
+	}
+	if opts.newerFile != "" {
+		info, err := os.Stat(opts.newerFile)
+		if err != nil {
+			return fmt.Errorf("cannot stat --newer-than-file: %v", err)
+		}
+		opts.newerFilter = true
+		opts.newerThan = info.ModTime()
+	}
+
+	for i, pattern := range opts.oldPatterns {
+		pair := replacement{old: pattern, new: opts.newPatterns[i]}
+		if !opts.fixed {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid -o pattern: %v", err)
+			}
+			pair.regex = re
+		}
+		opts.replacements = append(opts.replacements, pair)
+	}
+
+	return nil
+}
+
+// defaultOrder is the pipeline order of the --order steps when it is not given.
+var defaultOrder = []string{"tilda", "env", "clean", "absolute", "regex"}
+
+// resolveOrder places the listed steps as one block, in the given order, where the
+// earliest of them runs by default; steps not listed keep their default places.
+func resolveOrder(raw string) ([]string, error) {
+	listed := strings.Split(raw, ",")
+	for i, name := range listed {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(defaultOrder, name) {
+			return nil, fmt.Errorf("invalid --order step: %q (want %s)", name, strings.Join(defaultOrder, ", "))
+		}
+		if slices.Contains(listed[:i], name) {
+			return nil, fmt.Errorf("duplicate --order step: %q", name)
+		}
+		listed[i] = name
+	}
+	first := slices.IndexFunc(defaultOrder, func(name string) bool { return slices.Contains(listed, name) })
+	var order []string
+	for i, name := range defaultOrder {
+		switch {
+		case i == first:
+			order = append(order, listed...)
+		case !slices.Contains(listed, name):
+			order = append(order, name)
+		}
+	}
+	return order, nil
+}
+
+// parseParentLimit parses the -p value and returns a limit and unlimited flag.
+func parseParentLimit(raw string) (int, bool, error) {
+	if raw == "-" {
+		return 0, true, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 0 {
+		return 0, false, fmt.Errorf("invalid -p value: %q", raw)
+	}
+	return limit, false, nil
+}
+
+// relativeLimitError reports that -A could not relativize a path within the -p limit.
+func relativeLimitError(opts options) error {
+	return fmt.Errorf("cannot relativize against %s within -p %d", opts.baseAbs, opts.parentLimit)
+}
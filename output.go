@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cleanpath/pkg/cleanpath"
+)
+
+// writeSteps logs the steps of one path, limited to --log-stages, as aligned text or,
+// with --log-tsv, as name, from, and to columns.
+func writeSteps(w io.Writer, logs []logStep, opts options) {
+	for _, step := range logs {
+		if opts.logStages != nil && !opts.logStages[step.name] {
+			continue
+		}
+		if opts.logTSV {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", step.name, step.from, step.to)
+			continue
+		}
+		fmt.Fprintln(w, formatLogLine(step.name, step.from, step.to))
+	}
+}
+
+// warnAmbiguous logs the -b bases that tie for the path -A relativized, when the base
+// -A used is one of them. Nothing is logged when -A did not see an absolute path.
+func warnAmbiguous(w io.Writer, relFrom string, opts options) {
+	if !strings.HasPrefix(relFrom, opts.sep) {
+		return
+	}
+	tied, cost := tiedBases(relFrom, opts)
+	if len(tied) < 2 || !slices.Contains(tied, opts.baseAbs) {
+		return
+	}
+	if opts.logTSV {
+		fmt.Fprintf(w, "ambiguous\t%s\t%s\n", relFrom, strings.Join(tied, ","))
+	} else {
+		fmt.Fprintf(w, "cleanpath: %s: ambiguous bases %s tie at %d %s, using %s (last -b wins)\n",
+			relFrom, strings.Join(tied, ", "), cost, plural(cost, "segment", "segments"), opts.baseAbs)
+	}
+}
+
+// decorateOutput formats one output line: JSON or quoting, then the extra columns in
+// option order, then the --annotate input and the --parallel-files source in front.
+func decorateOutput(output, input, source string, logs []logStep, wasAbs bool, opts options) string {
+	depth := 0
+	if opts.reportDepth {
+		depth = cleanpath.DepthFromBase(cleanpath.MakeAbsoluteSep(output, opts.baseAbs, opts.sep), opts.baseAbs, opts.sep)
+	}
+	kind := ""
+	if opts.kind {
+		kind = pathKind(cleanpath.MakeAbsolute(output, opts.baseAbs))
+	}
+	if opts.jsonOut {
+		output = formatJSONRecord(input, output, logs)
+	}
+	if opts.quoteStyle != "" {
+		output = quotePath(output, opts.quoteStyle)
+	}
+	if opts.lastStage {
+		output += "\t" + lastStage(logs)
+	}
+	if opts.reportWasAbs {
+		output += "\t" + strconv.FormatBool(wasAbs)
+	}
+	if opts.reportDepth {
+		output += "\t" + strconv.Itoa(depth)
+	}
+	if opts.kind {
+		output += "\t" + kind
+	}
+	if opts.markSymlinks {
+		output += "\tlinks=" + strings.Join(resolvedLinks(logs, opts.baseAbs), ",")
+	}
+	if opts.annotate {
+		output = input + opts.annotateSep + output
+	}
+	if source != "" {
+		output = source + "\t" + output
+	}
+	return output
+}
+
+// resultWriter writes output lines as records, as one --output-sep line, or, on a
+// terminal with --table, as buffered rows aligned when the run finishes.
+type resultWriter struct {
+	out   io.Writer
+	opts  options
+	table bool
+	rows  [][]string
+	wrote bool
+}
+
+// newResultWriter returns a resultWriter for out, starting the table header when
+// --table applies.
+func newResultWriter(out io.Writer, opts options) *resultWriter {
+	w := &resultWriter{out: out, opts: opts, table: opts.table && isTerminal(out)}
+	if w.table {
+		header := []string{"INPUT", "OUTPUT"}
+		if opts.verbose {
+			header = append(header, "STEPS")
+		}
+		w.rows = append(w.rows, header)
+	}
+	return w
+}
+
+// write emits one output line for input.
+func (w *resultWriter) write(input, output string, logs []logStep) {
+	if w.table {
+		row := []string{input, output}
+		if w.opts.verbose {
+			row = append(row, stepNames(logs))
+		}
+		w.rows = append(w.rows, row)
+		return
+	}
+	// With --no-trailing-newline the terminator separates records instead of ending them.
+	switch {
+	case w.opts.outputSep != "":
+		if w.wrote {
+			fmt.Fprint(w.out, w.opts.outputSep)
+		}
+		fmt.Fprint(w.out, output)
+	case w.opts.noTrailing:
+		if w.wrote {
+			fmt.Fprint(w.out, recordTerminator(w.opts.null))
+		}
+		fmt.Fprint(w.out, output)
+	default:
+		fmt.Fprint(w.out, output+recordTerminator(w.opts.null))
+	}
+	w.wrote = true
+}
+
+// finish writes the buffered table, or ends the single --output-sep line.
+func (w *resultWriter) finish() {
+	if w.table {
+		for _, line := range formatTable(w.rows) {
+			fmt.Fprintln(w.out, line)
+		}
+		return
+	}
+	if w.opts.outputSep != "" && w.wrote && !w.opts.noTrailing {
+		fmt.Fprintln(w.out)
+	}
+}
+
+// teeWriter copies output to stdout and a --tee file. Each sink remembers its first
+// write error and is skipped afterwards, so one failing sink does not starve the other.
+type teeWriter struct {
+	out, file       io.Writer
+	outErr, fileErr error
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	if t.outErr == nil {
+		_, t.outErr = t.out.Write(b)
+	}
+	if t.fileErr == nil {
+		_, t.fileErr = t.file.Write(b)
+	}
+	return len(b), nil
+}
+
+// jsonStep is one logStep as written by --json.
+type jsonStep struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to,omitempty"`
+}
+
+// jsonRecord is the --json object written for each output path.
+type jsonRecord struct {
+	Input  string     `json:"input"`
+	Output string     `json:"output"`
+	Steps  []jsonStep `json:"steps"`
+}
+
+// formatJSONRecord renders an input, its output, and the steps between them as one JSON line.
+func formatJSONRecord(input, output string, steps []logStep) string {
+	record := jsonRecord{Input: input, Output: output, Steps: make([]jsonStep, 0, len(steps))}
+	for _, step := range steps {
+		record.Steps = append(record.Steps, jsonStep{Name: step.name, From: step.from, To: step.to})
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	// Encoding strings and slices of strings cannot fail.
+	_ = enc.Encode(record)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// describeClean summarizes what cleaning does to path, e.g. "would collapse 2 redundant slashes,
+// remove 1 '.' segment, resolve 1 '..'". Leading ".." of a relative path is kept and not counted.
+func describeClean(path, sep string) string {
+	var slashes, dots, parents, depth int
+	trailing := false
+	rooted := strings.HasPrefix(path, sep)
+	segments := strings.Split(path, sep)
+	for i, segment := range segments {
+		switch segment {
+		case "":
+			if i == len(segments)-1 && strings.Trim(path, sep) != "" {
+				trailing = true
+			} else if i > 0 {
+				slashes++
+			}
+		case ".":
+			dots++
+		case "..":
+			if depth > 0 {
+				depth--
+				parents++
+			} else if rooted {
+				parents++
+			}
+		default:
+			depth++
+		}
+	}
+
+	var changes []string
+	if slashes > 0 {
+		changes = append(changes, fmt.Sprintf("collapse %d redundant %s", slashes, plural(slashes, "slash", "slashes")))
+	}
+	if dots > 0 {
+		changes = append(changes, fmt.Sprintf("remove %d '.' %s", dots, plural(dots, "segment", "segments")))
+	}
+	if parents > 0 {
+		changes = append(changes, fmt.Sprintf("resolve %d '..'", parents))
+	}
+	if trailing {
+		changes = append(changes, "remove the trailing slash")
+	}
+	if len(changes) == 0 {
+		return "would normalize the path"
+	}
+	return "would " + strings.Join(changes, ", ")
+}
+
+// plural returns singular when n is 1 and pluralForm otherwise.
+func plural(n int, singular, pluralForm string) string {
+	if n == 1 {
+		return singular
+	}
+	return pluralForm
+}
+
+// lastStage returns the name of the last step that changed the path, or "none".
+func lastStage(steps []logStep) string {
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.name == "initial" || step.name == "final" || step.from == step.to {
+			continue
+		}
+		return step.name
+	}
+	return "none"
+}
+
+// formatLogLine formats a verbose log line with aligned step names.
+func formatLogLine(step, from, to string) string {
+	const stepWidth = 10
+	if to == "" {
+		return fmt.Sprintf("cleanpath %-*s %s", stepWidth, step, from)
+	}
+	return fmt.Sprintf("cleanpath %-*s %s -> %s", stepWidth, step, from, to)
+}
+
+// isTerminal reports whether w is a character device such as a TTY.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stepNames joins the names of the steps that changed a path, or returns "none".
+func stepNames(steps []logStep) string {
+	var names []string
+	for _, step := range steps {
+		if step.name == "initial" || step.name == "final" || step.from == step.to {
+			continue
+		}
+		names = append(names, step.name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// runStats accumulates the --stats summary for a batch.
+type runStats struct {
+	total   int
+	changed int
+	failed  int
+	saved   int
+	steps   map[string]int
+}
+
+// record counts one transformed path and each step that changed it.
+func (st *runStats) record(input, output string, logs []logStep) {
+	if output != input {
+		st.changed++
+		st.saved += len(input) - len(output)
+	}
+	for _, step := range logs {
+		if step.name != "initial" && step.name != "final" && step.from != step.to {
+			st.steps[step.name]++
+		}
+	}
+}
+
+// writeSavings prints the bytes trimmed from changed paths, negative when expansion grew them.
+func (st *runStats) writeSavings(w io.Writer) {
+	fmt.Fprintf(w, "cleanpath: savings: %d bytes across %d changed paths\n", st.saved, st.changed)
+}
+
+// write prints the summary, listing steps by how often they changed a path.
+func (st *runStats) write(w io.Writer) {
+	fmt.Fprintf(w, "cleanpath: stats: %d paths, %d changed, %d failed\n", st.total, st.changed, st.failed)
+	names := make([]string, 0, len(st.steps))
+	for name := range st.steps {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if st.steps[a] != st.steps[b] {
+			return st.steps[b] - st.steps[a]
+		}
+		return strings.Compare(a, b)
+	})
+	for _, name := range names {
+		fmt.Fprintf(w, "cleanpath: stats: %s %d\n", name, st.steps[name])
+	}
+}
+
+// formatTable pads each column to its widest cell and joins columns with " | ".
+func formatTable(rows [][]string) []string {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		var b strings.Builder
+		for i, cell := range row {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			b.WriteString(cell)
+			if i < len(row)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+			}
+		}
+		lines = append(lines, b.String())
+	}
+	return lines
+}
+
+// quotePath quotes and escapes a final path for the given output style.
+func quotePath(path, style string) string {
+	switch style {
+	case "shell":
+		return "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+	case "csv":
+		if !strings.ContainsAny(path, ",\"\r\n") {
+			return path
+		}
+		return `"` + strings.ReplaceAll(path, `"`, `""`) + `"`
+	case "json":
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		// Encoding a string cannot fail.
+		_ = enc.Encode(path)
+		return strings.TrimSuffix(b.String(), "\n")
+	case "c":
+		return quoteC(path)
+	}
+	return path
+}
+
+// quoteC renders a path as a C string literal, using octal escapes for control bytes.
+func quoteC(path string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&b, "\\%03o", c)
+				continue
+			}
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cleanpath/pkg/cleanpath"
+)
+
+// cleanPathPosix cleans path like cleanpath.Clean but follows the POSIX pathname resolution
+// rules (XBD 4.13) that survive a purely lexical treatment: exactly two leading slashes are
+// kept (their meaning is implementation-defined), three or more collapse to one, and a
+// trailing slash is kept because it requires the last component to be a directory. The
+// trailing slash rule applies to every path with a non-slash character, whatever it cleans
+// to, so "a/..//" gives "./" just as "../" gives "../"; a path of only slashes is a root.
+func cleanPathPosix(path string) string {
+	cleaned := cleanpath.Clean(path)
+	if strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "///") {
+		cleaned = "/" + cleaned
+	}
+	if strings.HasSuffix(path, "/") && strings.Trim(path, "/") != "" && !strings.HasSuffix(cleaned, "/") {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// windowsRoot splits a backslash-separated path into its root and the rest. The root
+// is a UNC \\server\share prefix, a drive (C:\ when rooted, C: when drive-relative),
+// a lone \, or empty for a relative path.
+func windowsRoot(path string) (string, string) {
+	if strings.HasPrefix(path, `\\`) {
+		parts := strings.SplitN(strings.TrimLeft(path, `\`), `\`, 3)
+		root := `\\` + strings.Join(parts[:min(len(parts), 2)], `\`)
+		if len(parts) < 3 {
+			return root, ""
+		}
+		return root, parts[2]
+	}
+	if len(path) >= 2 && path[1] == ':' && isDriveLetter(path[0]) {
+		if len(path) > 2 && path[2] == '\\' {
+			return path[:3], path[3:]
+		}
+		return path[:2], path[2:]
+	}
+	if strings.HasPrefix(path, `\`) {
+		return `\`, path[1:]
+	}
+	return "", path
+}
+
+// isDriveLetter reports whether b is an ASCII letter usable as a drive.
+func isDriveLetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// isWindowsAbs reports whether path starts at a drive root, a UNC share, or a \.
+func isWindowsAbs(path string) bool {
+	root, _ := windowsRoot(strings.ReplaceAll(path, "/", `\`))
+	return root != "" && !strings.HasSuffix(root, ":")
+}
+
+// cleanPathWindows cleans a Windows path, treating both \ and / as separators and
+// emitting backslashes. ".." never climbs above a drive root or UNC share.
+func cleanPathWindows(path string) string {
+	path = strings.ReplaceAll(path, "/", `\`)
+	root, rest := windowsRoot(path)
+	switch {
+	case root == "":
+		return cleanpath.CleanSep(rest, `\`)
+	case strings.HasSuffix(root, ":"):
+		// A drive-relative path such as C:foo keeps leading ".." like a relative path.
+		return root + cleanpath.CleanSep(rest, `\`)
+	}
+	cleaned := cleanpath.CleanSep(`\`+rest, `\`)
+	if strings.HasSuffix(root, `\`) {
+		return root + strings.TrimPrefix(cleaned, `\`)
+	}
+	if cleaned == `\` {
+		return root
+	}
+	return root + cleaned
+}
+
+var doubleSlashPattern = regexp.MustCompile(`/{2,}`)
+
+// cleanSlashes is the --slashes-only cleanup: it collapses repeated separators, drops "."
+// segments and a trailing separator, and leaves ".." segments where they are. An absolute
+// path keeps a single leading separator; a path left empty becomes ".".
+func cleanSlashes(path, sep string) string {
+	var kept []string
+	for _, seg := range strings.Split(path, sep) {
+		if seg != "" && seg != "." {
+			kept = append(kept, seg)
+		}
+	}
+	rest := strings.Join(kept, sep)
+	if strings.HasPrefix(path, sep) {
+		return sep + rest
+	}
+	if rest == "" {
+		return "."
+	}
+	return rest
+}
+
+// cleanPathKeepDouble cleans path but keeps each run of two or more slashes as "//",
+// cleaning the pieces between runs separately so ".." never crosses a "//".
+func cleanPathKeepDouble(path string) string {
+	pieces := doubleSlashPattern.Split(path, -1)
+	leading := len(pieces) > 1 && pieces[0] == ""
+	var kept []string
+	for i, piece := range pieces {
+		if i == 0 && leading {
+			continue
+		}
+		if cleaned := cleanpath.Clean(piece); cleaned != "." {
+			kept = append(kept, cleaned)
+		}
+	}
+	joined := strings.Join(kept, "//")
+	if leading {
+		return "//" + joined
+	}
+	if joined == "" {
+		return "."
+	}
+	return joined
+}
+
+var envRefPattern = regexp.MustCompile(`\$\w+|\$\{[^}]+\}`)
+
+// lowercaseSegments lowercases path but leaves a leading ~user segment, $VAR and ${VAR}
+// references, and (with windows) the drive or UNC root as they are.
+func lowercaseSegments(path, sep string, windows bool) string {
+	var kept string
+	if windows {
+		kept, path = windowsRoot(path)
+	}
+	if kept == "" && strings.HasPrefix(path, "~") {
+		end := strings.Index(path, sep)
+		if end < 0 {
+			end = len(path)
+		}
+		kept, path = path[:end], path[end:]
+	}
+	var b strings.Builder
+	b.WriteString(kept)
+	last := 0
+	for _, loc := range envRefPattern.FindAllStringIndex(path, -1) {
+		b.WriteString(strings.ToLower(path[last:loc[0]]))
+		b.WriteString(path[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(strings.ToLower(path[last:]))
+	return b.String()
+}
+
+// isDotfile reports whether segment is a hidden name such as .config, as opposed to
+// the . and .. navigation segments.
+func isDotfile(segment string) bool {
+	return strings.HasPrefix(segment, ".") && segment != "." && segment != ".."
+}
+
+// dotfileSegments returns the hidden segments of path, in order.
+func dotfileSegments(path, sep string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, sep) {
+		if isDotfile(seg) {
+			names = append(names, seg)
+		}
+	}
+	return names
+}
+
+// stripDotfiles removes every hidden segment from path, keeping its root (including
+// a Windows drive or UNC share with windows set). A path left empty becomes ".".
+func stripDotfiles(path, sep string, windows bool) string {
+	root := ""
+	if windows {
+		root, path = windowsRoot(path)
+	} else {
+		for strings.HasPrefix(path, sep) {
+			root += sep
+			path = path[len(sep):]
+		}
+	}
+	var kept []string
+	for _, seg := range strings.Split(path, sep) {
+		if !isDotfile(seg) {
+			kept = append(kept, seg)
+		}
+	}
+	rest := strings.Join(kept, sep)
+	if strings.HasPrefix(root, `\\`) && rest != "" {
+		rest = sep + rest
+	}
+	if root+rest == "" {
+		return "."
+	}
+	return root + rest
+}
+
+// parentDir returns the parent of a cleaned absolute path, keeping the root sep as its own parent.
+func parentDir(path, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	i := strings.LastIndex(path, sep)
+	if i <= 0 {
+		return sep
+	}
+	return path[:i]
+}
+
+// decodePercent decodes %XX byte escapes, leaving malformed escapes literal.
+func decodePercent(path string) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) && isHex(path[i+1]) && isHex(path[i+2]) {
+			value, _ := strconv.ParseUint(path[i+1:i+3], 16, 8)
+			b.WriteByte(byte(value))
+			i += 2
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// encodePercent escapes each segment of path with url.PathEscape, keeping the sep
+// separators between them, so "/a b/c?d" becomes "/a%20b/c%3Fd".
+func encodePercent(path, sep string) string {
+	segments := strings.Split(path, sep)
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, sep)
+}
+
+// isHex reports whether c is an ASCII hex digit.
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// formatForOS applies a target OS's separator convention to a final path: Windows uses
+// backslashes. Case is kept; foldForOS gives the form used to compare paths.
+func formatForOS(path, targetOS string) string {
+	if targetOS == "windows" {
+		return strings.ReplaceAll(path, "/", `\`)
+	}
+	return path
+}
+
+// foldForOS returns the form of path that is compared with others for targetOS. Windows
+// and macOS default to case-insensitive filesystems, so their paths compare in lower case.
+func foldForOS(path, targetOS string) string {
+	if targetOS == "windows" || targetOS == "darwin" {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// clampParents drops leading ".." segments of a cleaned relative path beyond limit.
+func clampParents(path string, limit int, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	segments := strings.Split(path, sep)
+	ups := 0
+	for ups < len(segments) && segments[ups] == ".." {
+		ups++
+	}
+	if ups <= limit {
+		return path
+	}
+	segments = segments[ups-limit:]
+	if len(segments) == 0 {
+		return "."
+	}
+	return strings.Join(segments, sep)
+}
+
+// joinAbsoluteSep is makeAbsoluteSep without the final cleanup, exposing the raw base join.
+func joinAbsoluteSep(path, baseAbs, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	if strings.HasPrefix(path, sep) || baseAbs == "" {
+		return path
+	}
+	return strings.TrimSuffix(baseAbs, sep) + sep + path
+}
+
+// tiedBases returns the -b bases that relativize path (within -p) to the fewest
+// segments, with that count, when more than one base reaches it. The last -b still
+// decides the output; the tie only shows the result depended on that choice.
+func tiedBases(path string, opts options) ([]string, int) {
+	var tied []string
+	best := -1
+	for _, base := range opts.basesAbs {
+		rel := cleanpath.MakeRelativeSep(path, base, opts.parentLimit, opts.unlimitedUp, opts.sep)
+		if strings.HasPrefix(rel, opts.sep) {
+			continue
+		}
+		cost := 0
+		if rel != "." {
+			cost = strings.Count(rel, opts.sep) + 1
+		}
+		switch {
+		case best < 0 || cost < best:
+			best = cost
+			tied = []string{base}
+		case cost == best && !slices.Contains(tied, base):
+			tied = append(tied, base)
+		}
+	}
+	return tied, best
+}
+
+// relativeColumns renders an absolute path relative to each root that contains it,
+// as tab-separated columns that are blank for roots that do not.
+func relativeColumns(path string, roots []string) string {
+	columns := make([]string, len(roots))
+	for i, root := range roots {
+		if hasPathPrefix(path, root) {
+			columns[i] = cleanpath.MakeRelative(path, root, 0, false)
+		}
+	}
+	return strings.Join(columns, "\t")
+}
+
+// commonSuffix returns the longest run of trailing segments shared by all paths, joined
+// with sep. Roots and empty segments are not segments, so the result is always relative,
+// and it is "" when the last segments differ or there are no paths.
+func commonSuffix(paths []string, sep string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	suffix := pathSegments(paths[0], sep)
+	for _, path := range paths[1:] {
+		segs := pathSegments(path, sep)
+		n := 0
+		for n < len(suffix) && n < len(segs) && suffix[len(suffix)-1-n] == segs[len(segs)-1-n] {
+			n++
+		}
+		suffix = suffix[len(suffix)-n:]
+	}
+	return strings.Join(suffix, sep)
+}
+
+// pathSegments splits path on sep, dropping the empty segments left by roots and repeats.
+func pathSegments(path, sep string) []string {
+	var segs []string
+	for _, seg := range strings.Split(path, sep) {
+		if seg != "" {
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
+
+// ancestorChain returns each leading prefix of a cleaned path, top-down, ending with the path itself.
+// The root (leading separators, or a drive or UNC share with windows) is never emitted on its own.
+func ancestorChain(path, sep string, windows bool) []string {
+	if sep == "" {
+		sep = "/"
+	}
+	start := 0
+	if windows {
+		root, _ := windowsRoot(path)
+		start = len(root)
+	} else {
+		for strings.HasPrefix(path[start:], sep) {
+			start += len(sep)
+		}
+	}
+	var chain []string
+	for i := start; i < len(path); {
+		j := strings.Index(path[i:], sep)
+		if j < 0 {
+			break
+		}
+		if j > 0 {
+			chain = append(chain, path[:i+j])
+		}
+		i += j + len(sep)
+	}
+	return append(chain, path)
+}
+
+// includeBaseName re-roots a path relative to baseAbs at the base's parent, so the
+// base's last component is kept as context.
+func includeBaseName(relative, baseAbs, sep string) string {
+	name := baseAbs[strings.LastIndex(baseAbs, sep)+len(sep):]
+	if name == "" {
+		return relative
+	}
+	return cleanpath.CleanSep(name+sep+relative, sep)
+}
+
+// trimSegments strips surrounding whitespace from the path and from each of its segments,
+// dropping segments that were only whitespace. Internal spaces are kept.
+func trimSegments(path, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	path = strings.TrimSpace(path)
+	isAbs := strings.HasPrefix(path, sep)
+	parts := strings.Split(path, sep)
+	out := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	joined := strings.Join(out, sep)
+	if isAbs {
+		return sep + joined
+	}
+	return joined
+}
+
+// renameSegments replaces every segment that exactly matches a key in renames.
+func renameSegments(path string, renames map[string]string, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	segments := strings.Split(path, sep)
+	for i, segment := range segments {
+		if renamed, ok := renames[segment]; ok {
+			segments[i] = renamed
+		}
+	}
+	return strings.Join(segments, sep)
+}
+
+// restoreTrailing re-appends a single trailing separator unless the path is a root or ".".
+func restoreTrailing(path, sep string) string {
+	if path == "." || strings.HasSuffix(path, sep) {
+		return path
+	}
+	return path + sep
+}
+
+// replaceExt swaps a trailing oldExt (e.g. ".tar.gz") for newExt on the final segment.
+// Dotfiles whose whole name is the extension and paths ending in a separator are left alone.
+func replaceExt(path, oldExt, newExt, sep string) string {
+	if strings.HasSuffix(path, sep) {
+		return path
+	}
+	name := path[strings.LastIndex(path, sep)+1:]
+	if len(name) <= len(oldExt) || !strings.HasSuffix(name, oldExt) {
+		return path
+	}
+	return strings.TrimSuffix(path, oldExt) + newExt
+}
+
+// topSegments keeps the first n segments of a cleaned path, plus the root for absolute paths.
+func topSegments(path string, n int, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	rest := strings.TrimPrefix(path, sep)
+	segments := strings.Split(rest, sep)
+	if len(segments) <= n {
+		return path
+	}
+	return path[:len(path)-len(rest)] + strings.Join(segments[:n], sep)
+}
+
+// addSiblingDot prefixes "./" (in terms of sep) to a relative path with no directory
+// component. With windows, drive-relative paths such as C:foo are left alone.
+func addSiblingDot(path, sep string, windows bool) string {
+	if sep == "" {
+		sep = "/"
+	}
+	if path == "" || path == "." || path == ".." || strings.Contains(path, sep) {
+		return path
+	}
+	if root, _ := windowsRoot(path); windows && root != "" {
+		return path
+	}
+	return "." + sep + path
+}
+
+// addDotSlash marks a relative result as relative to the current directory: "." becomes
+// "./" and sub/file becomes ./sub/file. Absolute paths and results that start with ".."
+// or "./" are returned unchanged.
+func addDotSlash(path, sep string) string {
+	switch {
+	case path == "" || strings.HasPrefix(path, sep):
+		return path
+	case path == ".":
+		return "." + sep
+	case path == ".." || strings.HasPrefix(path, ".."+sep) || strings.HasPrefix(path, "."+sep):
+		return path
+	}
+	return "." + sep + path
+}
+
+// isDirectChild reports whether a relative result names a single component under the base.
+func isDirectChild(path, sep string) bool {
+	if sep == "" {
+		sep = "/"
+	}
+	path = strings.TrimPrefix(path, "."+sep)
+	return path != "" && path != "." && path != ".." && !strings.Contains(path, sep)
+}
+
+// newAncestors returns the --ancestors chain of path, skipping directories already in
+// seen and adding the rest to it.
+func newAncestors(path string, seen map[string]struct{}, opts options) []string {
+	var dirs []string
+	for _, dir := range ancestorChain(path, opts.sep, opts.windows) {
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
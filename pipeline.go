@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cleanpath/pkg/cleanpath"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// transformResult is the outcome of transforming one input.
+type transformResult struct {
+	final  string
+	logs   []logStep
+	differ bool
+	err    error
+	// relFrom is the path -A relativized, for --warn-ambiguous; "" when -A did not run.
+	relFrom string
+}
+
+// transformInput runs the transform selected by opts (--rel-pairs, --compare-pairs, or the
+// main pipeline) on one input.
+func transformInput(input string, opts options) transformResult {
+	var result transformResult
+	switch {
+	case opts.relPairs:
+		result.final, result.logs, result.err = transformPairVerbose(input, opts)
+	case opts.comparePairs:
+		result.final, result.logs, result.differ, result.err = comparePairVerbose(input, opts)
+	default:
+		p, err := runPipeline(input, opts)
+		result.final, result.logs, result.relFrom, result.err = p.current, p.logs, p.relFrom, err
+	}
+	return result
+}
+
+// expandInput returns the inputs an argument stands for: its brace expansions with
+// --brace-expand, else the argument itself.
+func expandInput(arg string, opts options) ([]string, error) {
+	if opts.braceExpand {
+		return expandBraces(arg)
+	}
+	return []string{arg}, nil
+}
+
+// transformConcurrently transforms paths[len(done):] on opts.jobs workers and returns
+// done extended with their results, indexed like paths.
+func transformConcurrently(paths []string, done [][]transformResult, opts options) [][]transformResult {
+	results := make([][]transformResult, len(paths))
+	copy(results, done)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range opts.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				// An expansion error is reported when run reaches this path.
+				inputs, _ := expandInput(paths[i], opts)
+				for _, input := range inputs {
+					results[i] = append(results[i], transformInput(input, opts))
+				}
+			}
+		}()
+	}
+	for i := len(done); i < len(paths); i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// transformPath applies enabled transformations in order.
+func transformPath(path string, opts options) (string, error) {
+	result, _, err := transformPathVerbose(path, opts)
+	return result, err
+}
+
+// splitDevicePrefix splits leading scheme: and user@host: prefixes (anything up to a ':'
+// with no separator before it) from the path they precede. A path with nothing after
+// the prefixes is returned whole.
+func splitDevicePrefix(path, sep string) (string, string) {
+	rest := path
+	for {
+		i := strings.Index(rest, ":")
+		if i <= 0 || strings.Contains(rest[:i], sep) {
+			break
+		}
+		rest = rest[i+1:]
+	}
+	if rest == "" {
+		return "", path
+	}
+	return path[:len(path)-len(rest)], rest
+}
+
+// stageNames lists every step name a verbose log can contain, in default pipeline order.
+var stageNames = []string{
+	"initial", "percent", "tilda", "untilda", "hometoenv", "env", "envclean", "unenv", "symlinks", "rewrite",
+	"clean", "lowercase", "dotfiles", "maxup", "rename", "ext", "absolute", "unabsolute", "preferrel",
+	"trailing", "dotslash", "top", "siblingdot", "rootmarker", "regex", "device", "realpath", "targetos",
+	"cachekey", "encode", "prepend", "append", "final", "relpair", "match", "differ",
+}
+
+// logStep records one verbose pipeline step.
+type logStep struct {
+	name string
+	from string
+	to   string
+}
+
+// pipeline carries one path through transformPathVerbose, logging each step that changes it.
+type pipeline struct {
+	opts     options
+	current  string
+	logs     []logStep
+	dirInput bool
+	trailing bool
+	relFrom  string
+}
+
+// step records a change made by the named step and moves on to next.
+func (p *pipeline) step(name, next string) {
+	if next != p.current {
+		p.logs = append(p.logs, logStep{name: name, from: p.current, to: next})
+	}
+	p.current = next
+}
+
+// tilda runs tilda expansion and unexpansion and --home-to-env.
+func (p *pipeline) tilda() {
+	opts := p.opts
+	if opts.tildeExpand {
+		p.step("tilda", cleanpath.ExpandTilde(p.current, opts.libOptions()))
+	}
+	if opts.tildeUnexpand {
+		p.step("untilda", cleanpath.UnexpandTilde(p.current, opts.libOptions()))
+	}
+	if opts.homeToEnv {
+		p.step("hometoenv", homeToEnv(p.current, opts.resolvedHome, opts.windows))
+	}
+}
+
+// env runs environment variable expansion and unexpansion.
+func (p *pipeline) env() error {
+	opts := p.opts
+	if opts.envExpand && inEnvScope(p.current, opts) {
+		if opts.strictEnv {
+			if names := cleanpath.UnresolvedEnv(p.current, opts.libOptions()); len(names) > 0 {
+				return fmt.Errorf("undefined %s $%s (--strict-env)", plural(len(names), "variable", "variables"), strings.Join(names, ", $"))
+			}
+		}
+		before := p.current
+		p.step("env", cleanpath.ExpandEnv(p.current, opts.libOptions()))
+		if opts.cleanAfterEnv && p.current != before {
+			next := cleanVariant(p.current, opts)
+			if strings.HasSuffix(p.current, opts.sep) {
+				next = restoreTrailing(next, opts.sep)
+			}
+			p.step("envclean", next)
+		}
+	}
+	if opts.envUnexpand {
+		p.step("unenv", cleanpath.UnexpandEnv(p.current, opts.libOptions()))
+	}
+	return nil
+}
+
+// clean resolves the symlink map and prefix rewrites, cleans the path, and applies
+// the segment transforms that expect a cleaned path.
+func (p *pipeline) clean() error {
+	opts := p.opts
+	if opts.symlinks != nil {
+		next, err := resolveSymlinkMap(cleanpath.MakeAbsolute(p.current, opts.baseAbs), opts.symlinks, opts.maxLinkHops)
+		if err != nil {
+			return err
+		}
+		p.step("symlinks", next)
+	}
+	if opts.rewrites != nil {
+		p.step("rewrite", rewritePrefix(p.current, opts.rewrites, opts.sep))
+	}
+
+	next := p.current
+	if opts.windows {
+		next = strings.ReplaceAll(next, "/", `\`)
+	} else if opts.cacheKey {
+		next = strings.ReplaceAll(next, `\`, "/")
+	}
+	if opts.trimSpace {
+		next = trimSegments(next, opts.sep)
+	}
+	p.dirInput = strings.HasSuffix(next, opts.sep)
+	p.trailing = opts.keepTrailing && p.dirInput
+	p.step("clean", cleanVariant(next, opts))
+
+	if opts.lowercase {
+		p.step("lowercase", lowercaseSegments(p.current, opts.sep, opts.windows))
+	}
+	if opts.dotfiles == "strip" {
+		p.step("dotfiles", stripDotfiles(p.current, opts.sep, opts.windows))
+	}
+	if opts.clampUp {
+		p.step("maxup", clampParents(p.current, opts.maxUp, opts.sep))
+	}
+	if opts.renames != nil {
+		p.step("rename", renameSegments(p.current, opts.renames, opts.sep))
+	}
+	if opts.extOld != "" && !p.dirInput {
+		p.step("ext", replaceExt(p.current, opts.extOld, opts.extNew, opts.sep))
+	}
+	return nil
+}
+
+// cleanVariant cleans path with the rules opts selects: -w (where / also separates),
+// --posix, --keep-double-slash, --slashes-only, or plain cleaning on opts.sep.
+func cleanVariant(path string, opts options) string {
+	switch {
+	case opts.windows:
+		return cleanPathWindows(strings.ReplaceAll(path, "/", `\`))
+	case opts.posix:
+		return cleanPathPosix(path)
+	case opts.keepDouble:
+		return cleanPathKeepDouble(path)
+	case opts.slashesOnly:
+		return cleanSlashes(path, opts.sep)
+	}
+	return cleanpath.CleanSep(path, opts.sep)
+}
+
+// absolute makes the path absolute or relative to the base, then applies the
+// trailing slash and the options that shape relative results.
+func (p *pipeline) absolute() error {
+	opts := p.opts
+	if opts.absolute {
+		if opts.noCleanAbs {
+			p.step("absolute", joinAbsoluteSep(p.current, opts.baseAbs, opts.sep))
+		} else {
+			p.step("absolute", cleanpath.MakeAbsoluteSep(p.current, opts.baseAbs, opts.sep))
+		}
+	}
+	if opts.unabsolute {
+		p.relFrom = p.current
+		next := cleanpath.MakeRelativeSep(p.current, opts.baseAbs, opts.parentLimit, opts.unlimitedUp, opts.sep)
+		if opts.relStrict && strings.HasPrefix(next, opts.sep) {
+			return relativeLimitError(opts)
+		}
+		if opts.withBaseName && strings.HasPrefix(p.current, opts.sep) && !strings.HasPrefix(next, opts.sep) {
+			next = includeBaseName(next, opts.baseAbs, opts.sep)
+		}
+		if opts.preferShorter && len(next) > len(p.current) {
+			next = p.current
+		}
+		if opts.byteBudget > 0 && len(next) > opts.byteBudget {
+			abs := cleanpath.MakeAbsoluteSep(p.current, opts.baseAbs, opts.sep)
+			if len(abs) > opts.byteBudget {
+				return fmt.Errorf("neither %s (%d bytes) nor %s (%d bytes) fits --byte-budget %d", next, len(next), abs, len(abs), opts.byteBudget)
+			}
+			next = abs
+		}
+		p.step("unabsolute", next)
+	}
+	if opts.preferRel {
+		p.step("preferrel", cleanpath.MakeRelativeSep(cleanpath.MakeAbsoluteSep(p.current, opts.baseAbs, opts.sep), opts.baseAbs, 0, false, opts.sep))
+	}
+	if p.trailing {
+		p.step("trailing", restoreTrailing(p.current, opts.sep))
+	}
+	if opts.dotSlash {
+		p.step("dotslash", addDotSlash(p.current, opts.sep))
+	}
+	if opts.top > 0 {
+		p.step("top", topSegments(p.current, opts.top, opts.sep))
+	}
+	if opts.siblingDot {
+		p.step("siblingdot", addSiblingDot(p.current, opts.sep, opts.windows))
+	}
+	if opts.rootMarker != "" && isDirectChild(p.current, opts.sep) {
+		p.step("rootmarker", opts.rootMarker+p.current)
+	}
+	return nil
+}
+
+// regex applies each -o/-n pair in order, then --unexpand-after-regex.
+func (p *pipeline) regex() error {
+	opts := p.opts
+	for _, pair := range opts.replacements {
+		next, err := replaceRegex(p.current, pair, opts.regexTimeout)
+		if err != nil {
+			return err
+		}
+		p.step("regex", next)
+	}
+	if opts.untildaRegex {
+		p.step("untilda", cleanpath.UnexpandTilde(p.current, opts.libOptions()))
+	}
+	return nil
+}
+
+// transformPathVerbose applies transformations and returns the verbose steps.
+func transformPathVerbose(path string, opts options) (string, []logStep, error) {
+	p, err := runPipeline(path, opts)
+	return p.current, p.logs, err
+}
+
+// runPipeline runs the main pipeline on path and returns its final state, which holds
+// the result and the logged steps even when a step fails.
+func runPipeline(path string, opts options) (*pipeline, error) {
+	p := &pipeline{opts: opts, current: path, logs: []logStep{{name: "initial", from: path}}}
+
+	if opts.decodePercent {
+		p.step("percent", decodePercent(p.current))
+	}
+	device := ""
+	if opts.devicePrefix {
+		device, p.current = splitDevicePrefix(p.current, opts.sep)
+		if device != "" {
+			p.logs = append(p.logs, logStep{name: "device", from: device + p.current, to: p.current})
+		}
+	}
+
+	order := opts.order
+	if order == nil {
+		order = defaultOrder
+	}
+	for _, name := range order {
+		var err error
+		switch name {
+		case "tilda":
+			p.tilda()
+		case "env":
+			err = p.env()
+		case "clean":
+			err = p.clean()
+		case "absolute":
+			err = p.absolute()
+		case "regex":
+			err = p.regex()
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+
+	if device != "" {
+		p.step("device", device+p.current)
+	}
+	if opts.realpath {
+		p.step("realpath", resolveRealpath(p.current, opts.baseAbs))
+	}
+	if opts.targetOS != "" {
+		p.step("targetos", formatForOS(p.current, opts.targetOS))
+	}
+	if opts.cacheKey {
+		key := norm.NFC.String(p.current)
+		if opts.foldCase {
+			key = strings.ToLower(key)
+		}
+		p.step("cachekey", key)
+	}
+	if opts.encodePercent {
+		p.step("encode", encodePercent(p.current, opts.sep))
+	}
+	if opts.prepend != "" {
+		p.step("prepend", opts.prepend+p.current)
+	}
+	if opts.appendStr != "" {
+		p.step("append", p.current+opts.appendStr)
+	}
+
+	p.logs = append(p.logs, logStep{name: "final", from: p.current})
+	return p, nil
+}
+
+// transformPairVerbose computes the relative path from a linkpath's directory to its target.
+func transformPairVerbose(line string, opts options) (string, []logStep, error) {
+	target, link, ok := strings.Cut(line, "\t")
+	if !ok {
+		return line, nil, fmt.Errorf("expected target<TAB>linkpath")
+	}
+
+	target, logs, err := transformPathVerbose(target, opts)
+	if err != nil {
+		return line, logs, err
+	}
+	link, linkLogs, err := transformPathVerbose(link, opts)
+	logs = append(logs, linkLogs...)
+	if err != nil {
+		return line, logs, err
+	}
+
+	target = cleanpath.MakeAbsoluteSep(target, opts.baseAbs, opts.sep)
+	linkDir := parentDir(cleanpath.MakeAbsoluteSep(link, opts.baseAbs, opts.sep), opts.sep)
+	rel := cleanpath.MakeRelativeSep(target, linkDir, 0, true, opts.sep)
+	logs = append(logs, logStep{name: "relpair", from: target, to: rel})
+	return rel, logs, nil
+}
+
+// comparePairVerbose transforms both tab-separated columns of a line and reports whether they differ.
+func comparePairVerbose(line string, opts options) (string, []logStep, bool, error) {
+	left, right, ok := strings.Cut(line, "\t")
+	if !ok {
+		return line, nil, false, fmt.Errorf("expected two tab-separated columns")
+	}
+
+	left, logs, err := transformPathVerbose(left, opts)
+	if err != nil {
+		return line, logs, false, err
+	}
+	right, rightLogs, err := transformPathVerbose(right, opts)
+	logs = append(logs, rightLogs...)
+	if err != nil {
+		return line, logs, false, err
+	}
+
+	differ := foldForOS(left, opts.targetOS) != foldForOS(right, opts.targetOS)
+	label := "match"
+	if differ {
+		label = "differ"
+	}
+	logs = append(logs, logStep{name: label, from: left, to: right})
+	return left + "\t" + right, logs, differ, nil
+}
+
+// replacement is one -o/-n pair; regex is nil with --fixed, where old is matched literally.
+type replacement struct {
+	old   string
+	new   string
+	regex *regexp.Regexp
+}
+
+// replaceRegex applies one -o/-n replacement, bounded by timeout when it is non-zero.
+func replaceRegex(path string, pair replacement, timeout time.Duration) (string, error) {
+	if pair.regex == nil {
+		return strings.ReplaceAll(path, pair.old, pair.new), nil
+	}
+	if timeout == 0 {
+		return pair.regex.ReplaceAllString(path, pair.new), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The regexp package cannot be interrupted, so a timed-out replacement is abandoned
+	// and finishes in the background; the buffered channel lets it exit.
+	result := make(chan string, 1)
+	go func() {
+		result <- pair.regex.ReplaceAllString(path, pair.new)
+	}()
+
+	select {
+	case replaced := <-result:
+		return replaced, nil
+	case <-ctx.Done():
+		return path, fmt.Errorf("%w after %v", errRegexTimeout, timeout)
+	}
+}
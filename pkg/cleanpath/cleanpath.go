@@ -0,0 +1,527 @@
+// Package cleanpath normalizes filesystem-like paths without touching the filesystem.
+// It provides the lexical cleaning, tilda and environment variable handling, and
+// absolute/relative conversion used by the cleanpath command.
+package cleanpath
+
+import (
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Options holds the resolved settings for the tilda and environment transforms.
+type Options struct {
+	// Home is the home directory a bare ~ expands to and unexpands from.
+	Home string
+	// HomeFallback is used for a bare ~ when Home is empty.
+	HomeFallback string
+	// User is the user whose home ~ refers to; CurrentUser is the user Home belongs to.
+	// When they differ, unexpansion emits ~User instead of ~.
+	User        string
+	CurrentUser string
+	// ExtraHomes are additional unexpansion candidates; the longest match wins.
+	ExtraHomes []Home
+	// Windows lets \ end a ~name prefix and expands ~name to a sibling of Home
+	// (the profile layout, e.g. C:\Users\name) instead of looking the user up.
+	Windows bool
+	// LookupHome, when non-nil, replaces LookupUser for ~name and returns "" when
+	// the user is unknown.
+	LookupHome func(name string) string
+
+	// EnvAllowed lists the variables ExpandEnv may expand; EnvAll allows every
+	// variable, set or not.
+	EnvAllowed map[string]struct{}
+	EnvAll     bool
+	// EnvSnapshot, when non-nil, replaces the live environment for ExpandEnv.
+	EnvSnapshot map[string]string
+	// CleanEnvValues cleans each value as it is substituted, with CleanValue when it is
+	// non-nil (so a caller can match its own separator or path flavor) and Clean otherwise.
+	CleanEnvValues bool
+	CleanValue     func(value string) string
+	// TildeDefaults expands a leading ~ in the WORD of ${VAR:-WORD} or ${VAR:+WORD}
+	// when the WORD is used, as a shell does.
+	TildeDefaults bool
+	// EnvSubst enables ${VAR/OLD/NEW} and ${VAR//OLD/NEW}.
+	EnvSubst bool
+	// WinEnv also expands Windows-style %VAR% references, and makes UnexpandEnv emit them.
+	WinEnv bool
+	// EnvOrder and EnvValues drive UnexpandEnv; earlier names take precedence.
+	EnvOrder  []string
+	EnvValues map[string]string
+}
+
+// Clean normalizes a filesystem-like path without touching the filesystem.
+func Clean(path string) string {
+	return CleanSep(path, "/")
+}
+
+// CleanSep normalizes a path whose segments are separated by sep ("/" when empty).
+func CleanSep(path, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	if path == "" {
+		return "."
+	}
+
+	isAbs := strings.HasPrefix(path, sep)
+	parts := strings.Split(path, sep)
+
+	// Pre-seed with an empty segment for absolute paths so joining adds the root separator.
+	out := make([]string, 0, len(parts))
+	if isAbs {
+		out = append(out, "")
+	}
+
+	for _, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+
+		if part == ".." {
+			// Prevent navigating above root for absolute paths.
+			if len(out) > 0 {
+				if len(out) == 1 && out[0] == "" {
+					continue
+				}
+				if out[len(out)-1] != ".." {
+					out = out[:len(out)-1]
+					continue
+				}
+			}
+			if !isAbs {
+				out = append(out, "..")
+			}
+			continue
+		}
+
+		out = append(out, part)
+	}
+
+	if len(out) == 0 {
+		if isAbs {
+			return sep
+		}
+		return "."
+	}
+
+	if isAbs && len(out) == 1 && out[0] == "" {
+		return sep
+	}
+
+	return strings.Join(out, sep)
+}
+
+// MakeAbsolute returns an absolute path using the provided base when needed.
+func MakeAbsolute(path, baseAbs string) string {
+	return MakeAbsoluteSep(path, baseAbs, "/")
+}
+
+// MakeAbsoluteSep is MakeAbsolute for paths separated by sep ("/" when empty).
+func MakeAbsoluteSep(path, baseAbs, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	if path == "" {
+		return CleanSep(path, sep)
+	}
+	if strings.HasPrefix(path, sep) || baseAbs == "" {
+		return path
+	}
+	return CleanSep(baseAbs+sep+path, sep)
+}
+
+// MakeRelative returns a relative path from baseAbs when allowed by parent limits.
+func MakeRelative(path, baseAbs string, limit int, unlimited bool) string {
+	return MakeRelativeSep(path, baseAbs, limit, unlimited, "/")
+}
+
+// MakeRelativeSep is MakeRelative for paths separated by sep ("/" when empty).
+func MakeRelativeSep(path, baseAbs string, limit int, unlimited bool, sep string) string {
+	if sep == "" {
+		sep = "/"
+	}
+	if path == "" || !strings.HasPrefix(path, sep) || baseAbs == "" {
+		return path
+	}
+	if path == baseAbs {
+		return "."
+	}
+	pathSegs := splitAbsSep(path, sep)
+	baseSegs := splitAbsSep(baseAbs, sep)
+	commonLen := commonPrefixLen(pathSegs, baseSegs)
+	parentsNeeded := len(baseSegs) - commonLen
+	if !unlimited && parentsNeeded > limit {
+		return path
+	}
+
+	relSegs := make([]string, 0, parentsNeeded+len(pathSegs)-commonLen)
+	for i := 0; i < parentsNeeded; i++ {
+		relSegs = append(relSegs, "..")
+	}
+	relSegs = append(relSegs, pathSegs[commonLen:]...)
+	if len(relSegs) == 0 {
+		return "."
+	}
+	return strings.Join(relSegs, sep)
+}
+
+// splitAbs splits an absolute path into segments.
+func splitAbs(path string) []string {
+	return splitAbsSep(path, "/")
+}
+
+// splitAbsSep splits an absolute path on sep into segments.
+func splitAbsSep(path, sep string) []string {
+	parts := strings.Split(path, sep)
+	segments := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		segments = append(segments, part)
+	}
+	return segments
+}
+
+// DepthFromBase returns how many levels below baseAbs an absolute path lies, negative
+// when it must first climb above the base: levels down from the common prefix minus
+// levels up to it.
+func DepthFromBase(path, baseAbs, sep string) int {
+	pathSegs := splitAbsSep(path, sep)
+	baseSegs := splitAbsSep(baseAbs, sep)
+	common := commonPrefixLen(pathSegs, baseSegs)
+	return (len(pathSegs) - common) - (len(baseSegs) - common)
+}
+
+// commonPrefixLen finds the number of shared leading segments.
+func commonPrefixLen(a, b []string) int {
+	max := len(a)
+	if len(b) < max {
+		max = len(b)
+	}
+	n := 0
+	for n < max && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// userLookup is a cached user.Lookup result.
+type userLookup struct {
+	user *user.User
+	err  error
+}
+
+// userCache memoizes user.Lookup by name and is safe for concurrent use.
+var userCache sync.Map
+
+// LookupUser is a cached user.Lookup, so repeated ~user inputs resolve once.
+func LookupUser(name string) (*user.User, error) {
+	if cached, ok := userCache.Load(name); ok {
+		entry := cached.(userLookup)
+		return entry.user, entry.err
+	}
+	lookup, err := user.Lookup(name)
+	userCache.Store(name, userLookup{user: lookup, err: err})
+	return lookup, err
+}
+
+// ExpandTilde expands a leading tilda to a home directory.
+func ExpandTilde(path string, opts Options) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+
+	slash := strings.Index(path, "/")
+	if opts.Windows {
+		slash = strings.IndexAny(path, `/\`)
+	}
+	var prefix string
+	var rest string
+	if slash == -1 {
+		prefix = path[1:]
+		rest = ""
+	} else {
+		prefix = path[1:slash]
+		rest = path[slash:]
+	}
+
+	if prefix == "" {
+		if opts.Home == "" {
+			if opts.HomeFallback == "" {
+				return path
+			}
+			return opts.HomeFallback + rest
+		}
+		return opts.Home + rest
+	}
+
+	if opts.Windows {
+		profile := WindowsProfile(opts.Home, prefix)
+		if profile == "" {
+			return path
+		}
+		return profile + rest
+	}
+	home := ""
+	if opts.LookupHome != nil {
+		home = opts.LookupHome(prefix)
+	} else if lookup, err := LookupUser(prefix); err == nil {
+		home = lookup.HomeDir
+	}
+	if home == "" {
+		return path
+	}
+	return home + rest
+}
+
+// WindowsProfile returns the profile directory for name next to home, so
+// C:\Users\me gives C:\Users\name. It returns "" when home has no parent.
+func WindowsProfile(home, name string) string {
+	i := strings.LastIndexAny(home, `/\`)
+	if i < 0 {
+		return ""
+	}
+	return home[:i+1] + name
+}
+
+// Home is a home directory and the tilda form that replaces it.
+type Home struct {
+	Dir    string
+	Prefix string
+}
+
+// UnexpandTilde replaces a leading home directory with a tilda form, preferring the
+// longest matching home when several -u users are candidates.
+func UnexpandTilde(path string, opts Options) string {
+	prefix := "~"
+	if opts.User != "" && opts.User != opts.CurrentUser {
+		prefix = "~" + opts.User
+	}
+	candidates := append([]Home{{Dir: opts.Home, Prefix: prefix}}, opts.ExtraHomes...)
+
+	var best Home
+	for _, candidate := range candidates {
+		if candidate.Dir == "" || len(candidate.Dir) <= len(best.Dir) {
+			continue
+		}
+		if HasHomePrefix(path, candidate.Dir, opts.Windows) {
+			best = candidate
+		}
+	}
+	if best.Dir == "" {
+		return path
+	}
+
+	return best.Prefix + path[len(best.Dir):]
+}
+
+// HasHomePrefix reports whether path is home or lies beneath it. With windows, / and \
+// are both separators and the match ignores case, so C:\Users\Me matches c:/users/me/x.
+func HasHomePrefix(path, home string, windows bool) bool {
+	if len(path) < len(home) {
+		return false
+	}
+	head, rest := path[:len(home)], path[len(home):]
+	if windows {
+		slashes := strings.NewReplacer(`\`, "/")
+		return strings.EqualFold(slashes.Replace(head), slashes.Replace(home)) && (rest == "" || rest[0] == '/' || rest[0] == '\\')
+	}
+	return head == home && (rest == "" || rest[0] == '/')
+}
+
+// envRefs returns the [start, end) spans of the variable references in path: $NAME,
+// ${...} with nested braces matched, so ${A:-${B}/x} is one reference, and %NAME% when
+// winEnv is set. An unterminated ${ or an empty ${} is not a reference.
+func envRefs(path string, winEnv bool) [][2]int {
+	var refs [][2]int
+	for i := 0; i < len(path); i++ {
+		if end := envRefEnd(path, i, winEnv); end > i {
+			refs = append(refs, [2]int{i, end})
+			i = end - 1
+		}
+	}
+	return refs
+}
+
+// envRefEnd returns the end of the reference starting at i, or i when there is none.
+func envRefEnd(path string, i int, winEnv bool) int {
+	switch {
+	case strings.HasPrefix(path[i:], "${"):
+		depth := 0
+		for j := i + 1; j < len(path); j++ {
+			switch path[j] {
+			case '{':
+				depth++
+			case '}':
+				if depth--; depth == 0 {
+					if j == i+2 {
+						return i
+					}
+					return j + 1
+				}
+			}
+		}
+	case path[i] == '$':
+		if n := envNameLen(path[i+1:]); n > 0 {
+			return i + 1 + n
+		}
+	case winEnv && path[i] == '%':
+		if n := envNameLen(path[i+1:]); n > 0 && i+1+n < len(path) && path[i+1+n] == '%' {
+			return i + n + 2
+		}
+	}
+	return i
+}
+
+// envNameLen returns the length of the run of ASCII letters, digits, and underscores
+// at the start of s.
+func envNameLen(s string) int {
+	n := 0
+	for n < len(s) && (s[n] == '_' || '0' <= s[n] && s[n] <= '9' || 'a' <= s[n] && s[n] <= 'z' || 'A' <= s[n] && s[n] <= 'Z') {
+		n++
+	}
+	return n
+}
+
+// ExpandEnv expands $VAR and ${VAR} forms for variables in opts.EnvAllowed (any variable
+// with opts.EnvAll), optionally cleaning each substituted value. Values come from
+// opts.EnvSnapshot when it is non-nil, otherwise from the live environment.
+// ${VAR:-WORD} gives WORD when VAR is unset or empty and ${VAR:+WORD} gives WORD only
+// when VAR is non-empty; WORD is expanded in turn, so it may reference other variables
+// (and, with opts.TildeDefaults, start with ~), and either form is left literal when VAR
+// is not allowed. With opts.EnvSubst,
+// ${VAR/OLD/NEW} and ${VAR//OLD/NEW} replace the first or every literal OLD in the
+// value. With opts.WinEnv, %VAR% is expanded too, under the same allow-list.
+func ExpandEnv(path string, opts Options) string {
+	expanded, _ := expandEnvRefs(path, opts)
+	return expanded
+}
+
+// UnresolvedEnv returns the names of the $VAR and ${VAR...} (and, with opts.WinEnv,
+// %VAR%) references in path that ExpandEnv would leave literal, because the name is not
+// allowed or the variable is unset with no :- or :+ form to fall back on. References
+// inside a :- or :+ word count when that word is used. Names are listed once, in order
+// of appearance.
+func UnresolvedEnv(path string, opts Options) []string {
+	_, names := expandEnvRefs(path, opts)
+	return names
+}
+
+// expandEnvRefs expands every reference in path and collects the names left unresolved.
+func expandEnvRefs(path string, opts Options) (string, []string) {
+	var b strings.Builder
+	var unresolved []string
+	last := 0
+	for _, ref := range envRefs(path, opts.WinEnv) {
+		value, names := expandEnvRef(path[ref[0]:ref[1]], opts)
+		b.WriteString(path[last:ref[0]])
+		b.WriteString(value)
+		last = ref[1]
+		for _, name := range names {
+			if !slices.Contains(unresolved, name) {
+				unresolved = append(unresolved, name)
+			}
+		}
+	}
+	b.WriteString(path[last:])
+	return b.String(), unresolved
+}
+
+// expandEnvRef expands one reference. It returns the names left unresolved: the
+// reference's own name when it stays literal, or those inside a :- or :+ word it used.
+func expandEnvRef(ref string, opts Options) (string, []string) {
+	var name, spec, word string
+	var operator byte
+	hasSpec := false
+	switch {
+	case strings.HasPrefix(ref, "${"):
+		name = ref[2 : len(ref)-1]
+		if colon := strings.Index(name, ":"); colon > 0 && colon+1 < len(name) && (name[colon+1] == '-' || name[colon+1] == '+') {
+			name, operator, word = name[:colon], name[colon+1], name[colon+2:]
+		} else if slash := strings.Index(name, "/"); opts.EnvSubst && slash > 0 {
+			name, spec, hasSpec = name[:slash], name[slash+1:], true
+		} else if i := strings.IndexAny(name, ":/"); i > 0 {
+			// Other operators, and substitutions without EnvSubst, stay literal.
+			return ref, []string{name[:i]}
+		}
+	case strings.HasPrefix(ref, "%"):
+		name = ref[1 : len(ref)-1]
+	default:
+		name = ref[1:]
+	}
+	if name == "" {
+		return ref, nil
+	}
+	if _, ok := opts.EnvAllowed[name]; !ok && !opts.EnvAll {
+		return ref, []string{name}
+	}
+	value, ok := lookupEnv(name, opts.EnvSnapshot)
+	var unresolved []string
+	switch {
+	case operator == '-' && value == "", operator == '+' && value != "":
+		value, unresolved = expandEnvRefs(word, opts)
+		if opts.TildeDefaults {
+			value = ExpandTilde(value, opts)
+		}
+	case operator == '+':
+		value = ""
+	case !ok:
+		return ref, []string{name}
+	}
+	if hasSpec {
+		value = substituteValue(value, spec)
+	}
+	if opts.CleanEnvValues && value != "" {
+		if opts.CleanValue != nil {
+			value = opts.CleanValue(value)
+		} else {
+			value = Clean(value)
+		}
+	}
+	return value, unresolved
+}
+
+// substituteValue applies an OLD/NEW or /OLD/NEW substitution spec to value. OLD is
+// matched literally; an empty OLD leaves the value unchanged.
+func substituteValue(value, spec string) string {
+	count := 1
+	if strings.HasPrefix(spec, "/") {
+		spec = spec[1:]
+		count = -1
+	}
+	old, replacement, _ := strings.Cut(spec, "/")
+	if old == "" {
+		return value
+	}
+	return strings.Replace(value, old, replacement, count)
+}
+
+// UnexpandEnv replaces the values in opts.EnvValues with $NAME (%NAME% with opts.WinEnv),
+// in opts.EnvOrder.
+func UnexpandEnv(path string, opts Options) string {
+	for _, name := range opts.EnvOrder {
+		value := opts.EnvValues[name]
+		if value == "" {
+			continue
+		}
+		ref := "$" + name
+		if opts.WinEnv {
+			ref = "%" + name + "%"
+		}
+		path = strings.ReplaceAll(path, value, ref)
+	}
+	return path
+}
+
+// lookupEnv looks a variable up in snapshot when it is non-nil, else in the live environment.
+func lookupEnv(name string, snapshot map[string]string) (string, bool) {
+	if snapshot != nil {
+		value, ok := snapshot[name]
+		return value, ok
+	}
+	return os.LookupEnv(name)
+}
@@ -0,0 +1,351 @@
+package cleanpath
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+// TestClean verifies basic normalization cases.
+func TestClean(t *testing.T) {
+	cases := map[string]string{
+		"./aa/bb":        "aa/bb",
+		"/tmp/./aa//bb/": "/tmp/aa/bb",
+		"/":              "/",
+		"/../a":          "/a",
+		"/../../":        "/",
+		"../a":           "../a",
+		"../..":          "../..",
+		"a/../b":         "b",
+		"":               ".",
+		"a//b//c/..":     "a/b",
+	}
+
+	for input, want := range cases {
+		if got := Clean(input); got != want {
+			t.Fatalf("Clean(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestCleanSep verifies cleaning with non-slash separators, and "/" for an empty one.
+func TestCleanSep(t *testing.T) {
+	cases := []struct {
+		sep   string
+		input string
+		want  string
+	}{
+		{sep: ":", input: "a:.:b:..:c", want: "a:c"},
+		{sep: ":", input: "::a::b:", want: ":a:b"},
+		{sep: ":", input: ":..:a/b", want: ":a/b"},
+		{sep: "|", input: "|a||b|.|", want: "|a|b"},
+		{sep: "|", input: "..|x|..|..|y", want: "..|..|y"},
+		{sep: "", input: "/a/./b/", want: "/a/b"},
+	}
+	for _, tc := range cases {
+		if got := CleanSep(tc.input, tc.sep); got != tc.want {
+			t.Fatalf("CleanSep(%q, %q) = %q, want %q", tc.input, tc.sep, got, tc.want)
+		}
+	}
+}
+
+// TestMakeAbsoluteSep verifies relative paths are joined to the base and cleaned.
+func TestMakeAbsoluteSep(t *testing.T) {
+	cases := []struct {
+		path string
+		base string
+		sep  string
+		want string
+	}{
+		{path: "x/../y", base: "/base", sep: "/", want: "/base/y"},
+		{path: "/abs/./x", base: "/base", sep: "/", want: "/abs/./x"},
+		{path: "x", base: "", sep: "/", want: "x"},
+		{path: "", base: "/base", sep: "/", want: "."},
+		{path: "a:b", base: ":root", sep: ":", want: ":root:a:b"},
+	}
+	for _, tc := range cases {
+		if got := MakeAbsoluteSep(tc.path, tc.base, tc.sep); got != tc.want {
+			t.Fatalf("MakeAbsoluteSep(%q, %q, %q) = %q, want %q", tc.path, tc.base, tc.sep, got, tc.want)
+		}
+	}
+}
+
+// TestMakeRelativeSep verifies the parent limit and separator handling.
+func TestMakeRelativeSep(t *testing.T) {
+	cases := []struct {
+		path      string
+		limit     int
+		unlimited bool
+		sep       string
+		want      string
+	}{
+		{path: "/tmp/some-dir/a/b", sep: "/", want: "a/b"},
+		{path: "/tmp/some-dir", sep: "/", want: "."},
+		{path: "/tmp/foo", limit: 0, sep: "/", want: "/tmp/foo"},
+		{path: "/tmp/foo", limit: 1, sep: "/", want: "../foo"},
+		{path: "/foo", limit: 1, sep: "/", want: "/foo"},
+		{path: "/foo", unlimited: true, sep: "/", want: "../../foo"},
+		{path: "rel/x", unlimited: true, sep: "/", want: "rel/x"},
+		{path: ":tmp:some-dir:a", sep: ":", want: "a"},
+	}
+	for _, tc := range cases {
+		base := "/tmp/some-dir"
+		if tc.sep == ":" {
+			base = ":tmp:some-dir"
+		}
+		if got := MakeRelativeSep(tc.path, base, tc.limit, tc.unlimited, tc.sep); got != tc.want {
+			t.Fatalf("MakeRelativeSep(%q, %q, %d, %v) = %q, want %q", tc.path, base, tc.limit, tc.unlimited, got, tc.want)
+		}
+	}
+}
+
+// TestDepthFromBase verifies depths below, at, and above the base.
+func TestDepthFromBase(t *testing.T) {
+	cases := map[string]int{
+		"/a/b/c/d": 2,
+		"/a/b":     0,
+		"/a":       -1,
+		"/a/x/y":   1,
+		"/z":       -1,
+	}
+	for path, want := range cases {
+		if got := DepthFromBase(path, "/a/b", "/"); got != want {
+			t.Fatalf("DepthFromBase(%q, %q) = %d, want %d", path, "/a/b", got, want)
+		}
+	}
+}
+
+// TestExpandTilde verifies ~, ~name with a LookupHome hook, the fallback, and the
+// Windows profile layout.
+func TestExpandTilde(t *testing.T) {
+	lookup := func(name string) string {
+		if name == "alice" {
+			return "/home/alice"
+		}
+		return ""
+	}
+	opts := Options{Home: "/home/me", LookupHome: lookup}
+	cases := map[string]string{
+		"~":         "/home/me",
+		"~/x":       "/home/me/x",
+		"~alice/x":  "/home/alice/x",
+		"~nobody/x": "~nobody/x",
+		"x/~":       "x/~",
+	}
+	for input, want := range cases {
+		if got := ExpandTilde(input, opts); got != want {
+			t.Fatalf("ExpandTilde(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	if got := ExpandTilde("~/x", Options{HomeFallback: "/fallback"}); got != "/fallback/x" {
+		t.Fatalf("ExpandTilde with a fallback = %q, want %q", got, "/fallback/x")
+	}
+	if got := ExpandTilde("~/x", Options{}); got != "~/x" {
+		t.Fatalf("ExpandTilde without a home = %q, want %q", got, "~/x")
+	}
+
+	win := Options{Home: `C:\Users\me`, Windows: true}
+	if got := ExpandTilde(`~bob\docs`, win); got != `C:\Users\bob\docs` {
+		t.Fatalf("ExpandTilde on Windows = %q, want %q", got, `C:\Users\bob\docs`)
+	}
+	if got := WindowsProfile("home", "bob"); got != "" {
+		t.Fatalf("WindowsProfile without a parent = %q, want empty", got)
+	}
+}
+
+// TestUnexpandTilde verifies the longest matching home wins and ~user is used for
+// another user's home.
+func TestUnexpandTilde(t *testing.T) {
+	opts := Options{Home: "/home/me", ExtraHomes: []Home{{Dir: "/home/me/svc", Prefix: "~svc"}}}
+	cases := map[string]string{
+		"/home/me":         "~",
+		"/home/me/x":       "~/x",
+		"/home/me/svc/log": "~svc/log",
+		"/home/meow":       "/home/meow",
+	}
+	for input, want := range cases {
+		if got := UnexpandTilde(input, opts); got != want {
+			t.Fatalf("UnexpandTilde(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	other := Options{Home: "/home/alice", User: "alice", CurrentUser: "me"}
+	if got := UnexpandTilde("/home/alice/x", other); got != "~alice/x" {
+		t.Fatalf("UnexpandTilde for another user = %q, want %q", got, "~alice/x")
+	}
+
+	windows := Options{Home: `C:\Users\me`, Windows: true}
+	for input, want := range map[string]string{
+		`C:\Users\me\docs`: `~\docs`,
+		`c:\users\ME\docs`: `~\docs`,
+		`C:\Users\me`:      `~`,
+		`C:/Users/me/docs`: `~/docs`,
+		`C:\Users\meow`:    `C:\Users\meow`,
+	} {
+		if got := UnexpandTilde(input, windows); got != want {
+			t.Fatalf("UnexpandTilde(%q) with Windows = %q, want %q", input, got, want)
+		}
+	}
+	if got := UnexpandTilde(`C:\Users\me\docs`, Options{Home: `C:\Users\me`}); got != `C:\Users\me\docs` {
+		t.Fatalf("UnexpandTilde without Windows = %q, want it unchanged", got)
+	}
+}
+
+// TestExpandEnv verifies the allow-list, snapshots, %VAR%, and value cleaning.
+func TestExpandEnv(t *testing.T) {
+	snapshot := map[string]string{"APP": "/opt/./app/", "HOME": "/home/me"}
+	allowed := map[string]struct{}{"APP": {}}
+	opts := Options{EnvAllowed: allowed, EnvSnapshot: snapshot}
+	cases := map[string]string{
+		"$APP/bin":        "/opt/./app//bin",
+		"${APP}/bin":      "/opt/./app//bin",
+		"$HOME/x":         "$HOME/x",
+		"$APPX/x":         "$APPX/x",
+		"%APP%/x":         "%APP%/x",
+		"${}/x":           "${}/x",
+		"${APP:?err}/bin": "${APP:?err}/bin",
+	}
+	for input, want := range cases {
+		if got := ExpandEnv(input, opts); got != want {
+			t.Fatalf("ExpandEnv(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	opts.CleanEnvValues = true
+	if got := ExpandEnv("${APP}/bin", opts); got != "/opt/app/bin" {
+		t.Fatalf("ExpandEnv cleaned = %q, want %q", got, "/opt/app/bin")
+	}
+	opts.WinEnv = true
+	if got := ExpandEnv(`%APP%\bin`, opts); got != `/opt/app\bin` {
+		t.Fatalf("ExpandEnv with WinEnv = %q, want %q", got, `/opt/app\bin`)
+	}
+	if got := ExpandEnv("$HOME/x", Options{EnvAll: true, EnvSnapshot: snapshot}); got != "/home/me/x" {
+		t.Fatalf("ExpandEnv with EnvAll = %q, want %q", got, "/home/me/x")
+	}
+}
+
+// TestExpandEnvSubst verifies ${VAR/OLD/NEW} replaces literally and only when enabled.
+func TestExpandEnvSubst(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_SUBST", "/srv/v1/data/v1")
+	allowed := map[string]struct{}{"CLEANPATH_TEST_SUBST": {}}
+	cases := map[string]string{
+		"${CLEANPATH_TEST_SUBST/v1/v2}/x":     "/srv/v2/data/v1/x",
+		"${CLEANPATH_TEST_SUBST//v1/v2}/x":    "/srv/v2/data/v2/x",
+		"${CLEANPATH_TEST_SUBST//v1/a/b}":     "/srv/a/b/data/a/b",
+		"${CLEANPATH_TEST_SUBST/./x}":         "/srv/v1/data/v1",
+		"${CLEANPATH_TEST_SUBST/data}":        "/srv/v1//v1",
+		"${CLEANPATH_TEST_UNSET/v1/v2}/x":     "${CLEANPATH_TEST_UNSET/v1/v2}/x",
+		"${CLEANPATH_TEST_SUBST}/${HOME/a/b}": "/srv/v1/data/v1/${HOME/a/b}",
+	}
+	for input, want := range cases {
+		if got := ExpandEnv(input, Options{EnvAllowed: allowed, EnvSubst: true}); got != want {
+			t.Fatalf("ExpandEnv(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	input := "${CLEANPATH_TEST_SUBST/v1/v2}"
+	if got := ExpandEnv(input, Options{EnvAllowed: allowed}); got != input {
+		t.Fatalf("ExpandEnv without EnvSubst = %q, want it left literal", got)
+	}
+}
+
+// TestExpandEnvDefaults verifies ${VAR:-WORD} and ${VAR:+WORD} for set, empty, unset,
+// and disallowed variables, including words that reference other variables.
+func TestExpandEnvDefaults(t *testing.T) {
+	t.Setenv("CLEANPATH_TEST_SET", "/srv")
+	t.Setenv("CLEANPATH_TEST_EMPTY", "")
+	t.Setenv("CLEANPATH_TEST_UNSET", "")
+	os.Unsetenv("CLEANPATH_TEST_UNSET")
+	allowed := map[string]struct{}{"CLEANPATH_TEST_SET": {}, "CLEANPATH_TEST_EMPTY": {}, "CLEANPATH_TEST_UNSET": {}}
+	cases := map[string]string{
+		"${CLEANPATH_TEST_SET:-/opt}/x":                        "/srv/x",
+		"${CLEANPATH_TEST_EMPTY:-/opt}/x":                      "/opt/x",
+		"${CLEANPATH_TEST_UNSET:-/opt}/x":                      "/opt/x",
+		"${CLEANPATH_TEST_UNSET:-}/x":                          "/x",
+		"${CLEANPATH_TEST_SET:+/alt}/x":                        "/alt/x",
+		"${CLEANPATH_TEST_EMPTY:+/alt}/x":                      "/x",
+		"${CLEANPATH_TEST_UNSET:+/alt}/x":                      "/x",
+		"${CLEANPATH_TEST_OTHER:-/opt}/x":                      "${CLEANPATH_TEST_OTHER:-/opt}/x",
+		"${CLEANPATH_TEST_OTHER:+/alt}/x":                      "${CLEANPATH_TEST_OTHER:+/alt}/x",
+		"${CLEANPATH_TEST_UNSET:-a/b}/${CLEANPATH_TEST_UNSET}": "a/b/${CLEANPATH_TEST_UNSET}",
+	}
+	for input, want := range cases {
+		if got := ExpandEnv(input, Options{EnvAllowed: allowed, EnvSubst: true}); got != want {
+			t.Fatalf("ExpandEnv(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	nested := map[string]string{
+		"${CLEANPATH_TEST_UNSET:-$CLEANPATH_TEST_SET/../shared}/x": "/srv/../shared/x",
+		"${CLEANPATH_TEST_UNSET:-${CLEANPATH_TEST_SET}/x}/y":       "/srv/x/y",
+		"${CLEANPATH_TEST_SET:+${CLEANPATH_TEST_UNSET:-/a}}/b":     "/a/b",
+		"${CLEANPATH_TEST_UNSET:-${CLEANPATH_TEST_OTHER}}/x":       "${CLEANPATH_TEST_OTHER}/x",
+		"${CLEANPATH_TEST_UNSET:-${}/x":                            "${CLEANPATH_TEST_UNSET:-${}/x",
+	}
+	for input, want := range nested {
+		if got := ExpandEnv(input, Options{EnvAllowed: allowed}); got != want {
+			t.Fatalf("ExpandEnv(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	// TildeDefaults expands a leading ~ in a WORD that is used, and only then.
+	tilde := Options{EnvAllowed: allowed, Home: "/home/me", TildeDefaults: true}
+	for input, want := range map[string]string{
+		"${CLEANPATH_TEST_UNSET:-~/../shared}/x": "/home/me/../shared/x",
+		"${CLEANPATH_TEST_SET:+~/alt}/x":         "/home/me/alt/x",
+		"${CLEANPATH_TEST_SET:-~/../shared}/x":   "/srv/x",
+		"${CLEANPATH_TEST_UNSET:-/opt/~}/x":      "/opt/~/x",
+	} {
+		if got := ExpandEnv(input, tilde); got != want {
+			t.Fatalf("ExpandEnv(%q) with TildeDefaults = %q, want %q", input, got, want)
+		}
+	}
+	if got := ExpandEnv("${CLEANPATH_TEST_UNSET:-~/x}", Options{EnvAllowed: allowed, Home: "/home/me"}); got != "~/x" {
+		t.Fatalf("ExpandEnv without TildeDefaults = %q, want %q", got, "~/x")
+	}
+
+	// EnvAll makes every variable eligible, so an unset one still takes its default.
+	all := Options{EnvAll: true}
+	if got := ExpandEnv("${CLEANPATH_TEST_UNSET:-/opt}/$CLEANPATH_TEST_UNSET", all); got != "/opt/$CLEANPATH_TEST_UNSET" {
+		t.Fatalf("ExpandEnv with EnvAll = %q, want %q", got, "/opt/$CLEANPATH_TEST_UNSET")
+	}
+}
+
+// TestUnresolvedEnv verifies the names ExpandEnv leaves literal, listed once in order.
+func TestUnresolvedEnv(t *testing.T) {
+	snapshot := map[string]string{"SET": "/srv"}
+	allowed := map[string]struct{}{"SET": {}, "UNSET": {}}
+	opts := Options{EnvAllowed: allowed, EnvSnapshot: snapshot}
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{input: "$SET/x", want: nil},
+		{input: "$UNSET/$OTHER/$UNSET", want: []string{"UNSET", "OTHER"}},
+		{input: "${UNSET:-/opt}/x", want: nil},
+		{input: "${UNSET:-$OTHER}/x", want: []string{"OTHER"}},
+		{input: "${SET:-$OTHER}/x", want: nil},
+		{input: "${SET/a/b}", want: []string{"SET"}},
+	}
+	for _, tc := range cases {
+		if got := UnresolvedEnv(tc.input, opts); !slices.Equal(got, tc.want) {
+			t.Fatalf("UnresolvedEnv(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+// TestUnexpandEnv verifies values are replaced in order, skipping empty ones.
+func TestUnexpandEnv(t *testing.T) {
+	opts := Options{
+		EnvOrder:  []string{"APP", "ROOT", "EMPTY"},
+		EnvValues: map[string]string{"APP": "/srv/app", "ROOT": "/srv", "EMPTY": ""},
+	}
+	if got := UnexpandEnv("/srv/app/bin:/srv/x", opts); got != "$APP/bin:$ROOT/x" {
+		t.Fatalf("UnexpandEnv = %q, want %q", got, "$APP/bin:$ROOT/x")
+	}
+	opts.WinEnv = true
+	if got := UnexpandEnv("/srv/app/bin", opts); got != "%APP%/bin" {
+		t.Fatalf("UnexpandEnv with WinEnv = %q, want %q", got, "%APP%/bin")
+	}
+}